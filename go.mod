@@ -6,15 +6,15 @@ require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/fluent/fluent-bit-go v0.0.0-20201210173045-3fd1e0486df2
 	github.com/go-playground/validator/v10 v10.9.0
-	github.com/golang/protobuf v1.5.2
-	github.com/json-iterator/go v1.1.11
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/client_model v0.2.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.7.0
 	github.com/valyala/fasthttp v1.28.0
-	github.com/yandex-cloud/go-genproto v0.0.0-20210816122645-072f0f433ffb
-	github.com/yandex-cloud/go-sdk v0.0.0-20210816123146-aedab61cdc84 // indirect
-	google.golang.org/genproto v0.0.0-20210813162853-db860fec028c // indirect
-	google.golang.org/grpc v1.40.0
+	github.com/yandex-cloud/go-genproto v0.0.0-20240318083951-4fe6125f286e
+	github.com/yandex-cloud/go-sdk v0.0.0-20240318084659-dfa50323a0b4
+	google.golang.org/genproto v0.0.0-20211021150943-2b146023228c
+	google.golang.org/grpc v1.41.0
 	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,203 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"yandex_logging/plugin/dto"
+)
+
+var ErrQueueFull = errors.New("Async queue is full")
+
+const (
+	// AsyncBackpressureBlock waits until workers free enough space in the queue
+	AsyncBackpressureBlock = "block"
+	// AsyncBackpressureDropOldest drops the oldest queued events to make space for new ones
+	AsyncBackpressureDropOldest = "drop_oldest"
+	// AsyncBackpressureDropNewest drops new events which don't fit into the queue
+	AsyncBackpressureDropNewest = "drop_newest"
+	// AsyncBackpressureRetry makes fluent-bit retry the chunk which doesn't fit into the queue
+	AsyncBackpressureRetry = "retry"
+
+	defaultAsyncQueueSize = 10000
+	defaultAsyncWorkers   = 2
+)
+
+// eventQueue is a bounded FIFO queue of events shared by the flush and the workers
+type eventQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	events   []*Event
+	capacity int
+	closed   bool
+}
+
+func newEventQueue(capacity int) *eventQueue {
+	q := &eventQueue{capacity: capacity}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds events to the queue applying the backpressure policy if they don't fit.
+// It returns the number of dropped events.
+func (q *eventQueue) Push(events []*Event, backpressure string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return 0, errors.New("async queue is closed")
+	}
+	dropped := 0
+	switch backpressure {
+	case AsyncBackpressureRetry:
+		// a chunk larger than the queue is taken by the empty queue, otherwise it would be retried forever
+		if len(q.events) > 0 && len(q.events)+len(events) > q.capacity {
+			return 0, errors.Wrapf(ErrQueueFull, "%d of %d events queued, %d more don't fit", len(q.events), q.capacity, len(events))
+		}
+		q.events = append(q.events, events...)
+	case AsyncBackpressureDropNewest:
+		free := q.capacity - len(q.events)
+		if free < len(events) {
+			dropped = len(events) - free
+			events = events[:free]
+		}
+		q.events = append(q.events, events...)
+	case AsyncBackpressureDropOldest:
+		q.events = append(q.events, events...)
+		if len(q.events) > q.capacity {
+			dropped = len(q.events) - q.capacity
+			q.events = append([]*Event(nil), q.events[dropped:]...)
+		}
+	default:
+		// events are added as space is freed, so chunks larger than the queue don't block forever
+		for len(events) > 0 {
+			for len(q.events) >= q.capacity && !q.closed {
+				q.cond.Wait()
+			}
+			if q.closed {
+				return dropped, errors.New("async queue is closed")
+			}
+			n := q.capacity - len(q.events)
+			if n > len(events) {
+				n = len(events)
+			}
+			q.events = append(q.events, events[:n]...)
+			events = events[n:]
+			q.cond.Broadcast()
+		}
+	}
+	q.cond.Broadcast()
+	return dropped, nil
+}
+
+// Pop waits for events and takes up to max of them. nil is returned when the queue is closed and empty.
+func (q *eventQueue) Pop(max int) []*Event {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.events) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.events) == 0 {
+		return nil
+	}
+	if max > len(q.events) {
+		max = len(q.events)
+	}
+	events := append([]*Event(nil), q.events[:max]...)
+	q.events = q.events[max:]
+	q.cond.Broadcast()
+	return events
+}
+
+// Len returns the number of queued events
+func (q *eventQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events)
+}
+
+// Close wakes up waiting workers, they take remaining events and stop
+func (q *eventQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// asyncLogSender queues events and sends them with background workers, so the flush doesn't wait for requests.
+// Fluent-bit considers queued events delivered, failed requests are not retried by it.
+type asyncLogSender struct {
+	config       OutputPluginConfig
+	sender       LogSender
+	queue        *eventQueue
+	backpressure string
+	batchSize    int
+	metrics      pluginMetrics
+	workers      sync.WaitGroup
+}
+
+// NewAsyncLogSender starts async_workers workers sending events queued for the sender
+func NewAsyncLogSender(config OutputPluginConfig, sender LogSender) *asyncLogSender {
+	batchSize := config.MaxRequestEntries
+	if batchSize <= 0 {
+		batchSize = defaultMaxRequestEntries
+	}
+	s := &asyncLogSender{
+		config:       config,
+		sender:       sender,
+		queue:        newEventQueue(config.AsyncQueueSize),
+		backpressure: config.AsyncBackpressure,
+		batchSize:    batchSize,
+		metrics:      newPluginMetrics(config.PluginInstanceId),
+	}
+	for i := 0; i < config.AsyncWorkers; i++ {
+		s.workers.Add(1)
+		go s.work(i)
+	}
+	return s
+}
+
+// Send queues events. ErrQueueFull is returned if they don't fit and async_backpressure is `retry`.
+func (s *asyncLogSender) Send(events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	dropped, err := s.queue.Push(events, s.backpressure)
+	s.metrics.setQueueSize(s.queue.Len())
+	if dropped > 0 {
+		log.Warnf("[yandexcloud %d] async queue is full, %d events dropped", s.config.PluginInstanceId, dropped)
+		s.metrics.queueDropped(dropped)
+	}
+	return err
+}
+
+func (s *asyncLogSender) work(worker int) {
+	defer s.workers.Done()
+	for {
+		events := s.queue.Pop(s.batchSize)
+		if events == nil {
+			return
+		}
+		s.metrics.setQueueSize(s.queue.Len())
+		if err := s.sender.Send(events); err != nil {
+			log.Errorf("[yandexcloud %d] async worker %d failed to send %d events: %v",
+				s.config.PluginInstanceId, worker, len(events), err)
+		}
+	}
+}
+
+func (s *asyncLogSender) getToken() (string, error) {
+	return s.sender.getToken()
+}
+
+func (s *asyncLogSender) doRequest(reqModel *dto.YCLogRecordRequestModel) error {
+	return s.sender.doRequest(reqModel)
+}
+
+// Close waits for workers to send queued events and closes the sender
+func (s *asyncLogSender) Close() error {
+	s.queue.Close()
+	s.workers.Wait()
+	return s.sender.Close()
+}
@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestQueueEvents(from, to int) []*Event {
+	var events []*Event
+	for i := from; i < to; i++ {
+		events = append(events, &Event{Record: map[interface{}]interface{}{"message": fmt.Sprintf("test_message_%d", i)}})
+	}
+	return events
+}
+
+func queueMessages(events []*Event) []string {
+	var messages []string
+	for _, e := range events {
+		messages = append(messages, e.Record["message"].(string))
+	}
+	return messages
+}
+
+func Test_EventQueue_Backpressure(t *testing.T) {
+	t.Run(AsyncBackpressureDropNewest, func(t *testing.T) {
+		q := newEventQueue(3)
+		dropped, err := q.Push(newTestQueueEvents(0, 5), AsyncBackpressureDropNewest)
+		require.NoError(t, err)
+		assert.Equal(t, 2, dropped)
+		assert.Equal(t, []string{"test_message_0", "test_message_1", "test_message_2"}, queueMessages(q.Pop(10)))
+	})
+
+	t.Run(AsyncBackpressureDropOldest, func(t *testing.T) {
+		q := newEventQueue(3)
+		dropped, err := q.Push(newTestQueueEvents(0, 5), AsyncBackpressureDropOldest)
+		require.NoError(t, err)
+		assert.Equal(t, 2, dropped)
+		assert.Equal(t, []string{"test_message_2", "test_message_3", "test_message_4"}, queueMessages(q.Pop(10)))
+	})
+
+	t.Run(AsyncBackpressureRetry, func(t *testing.T) {
+		q := newEventQueue(3)
+		_, err := q.Push(newTestQueueEvents(0, 2), AsyncBackpressureRetry)
+		require.NoError(t, err)
+		_, err = q.Push(newTestQueueEvents(2, 4), AsyncBackpressureRetry)
+		assert.True(t, errors.Is(err, ErrQueueFull))
+		assert.Equal(t, 2, q.Len(), "chunk should not be queued partially")
+
+		q.Pop(10)
+		_, err = q.Push(newTestQueueEvents(0, 5), AsyncBackpressureRetry)
+		assert.NoError(t, err, "empty queue should take a chunk larger than the queue")
+	})
+
+	t.Run(AsyncBackpressureBlock, func(t *testing.T) {
+		q := newEventQueue(3)
+		pushed := make(chan error)
+		go func() {
+			_, err := q.Push(newTestQueueEvents(0, 5), AsyncBackpressureBlock)
+			pushed <- err
+		}()
+
+		var messages []string
+		for len(messages) < 5 {
+			messages = append(messages, queueMessages(q.Pop(2))...)
+		}
+		require.NoError(t, <-pushed)
+		assert.Equal(t, []string{"test_message_0", "test_message_1", "test_message_2", "test_message_3", "test_message_4"}, messages)
+	})
+}
+
+func Test_EventQueue_Close(t *testing.T) {
+	q := newEventQueue(3)
+	_, err := q.Push(newTestQueueEvents(0, 2), AsyncBackpressureBlock)
+	require.NoError(t, err)
+	q.Close()
+
+	assert.Equal(t, 2, len(q.Pop(10)), "remaining events should be taken after close")
+	assert.Nil(t, q.Pop(10))
+	_, err = q.Push(newTestQueueEvents(0, 1), AsyncBackpressureBlock)
+	assert.Error(t, err)
+}
+
+func Test_AsyncLogSender(t *testing.T) {
+	var mu sync.Mutex
+	var messages []string
+	mockLogSender := &MockLogSender{}
+	mockLogSender.On("Send", mock.Anything).Run(func(args mock.Arguments) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		messages = append(messages, queueMessages(args.Get(0).([]*Event))...)
+	}).Return(nil)
+	mockLogSender.On("Close").Return(nil)
+
+	sender := NewAsyncLogSender(OutputPluginConfig{
+		MaxRequestEntries: 2,
+		AsyncQueueSize:    100,
+		AsyncWorkers:      3,
+		AsyncBackpressure: AsyncBackpressureBlock,
+	}, mockLogSender)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sender.Send(newTestQueueEvents(i*5, i*5+5)))
+	}
+	require.NoError(t, sender.Close())
+
+	assert.ElementsMatch(t, queueMessages(newTestQueueEvents(0, 50)), messages, "queued events should be sent before close")
+	mockLogSender.AssertCalled(t, "Close")
+	for _, call := range mockLogSender.Calls {
+		if call.Method == "Send" {
+			assert.LessOrEqual(t, len(call.Arguments.Get(0).([]*Event)), 2)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	iampb "github.com/yandex-cloud/go-genproto/yandex/cloud/iam/v1"
+	ycsdk "github.com/yandex-cloud/go-sdk"
+	"github.com/yandex-cloud/go-sdk/iamkey"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// AuthModeServiceAccountKey exchanges the service account key for IAM token
+	AuthModeServiceAccountKey = "service_account_key"
+	// AuthModeMetadata gets IAM token of the instance service account from the metadata service
+	AuthModeMetadata = "metadata"
+	// AuthModeIAMToken uses IAM token given by iam_token option or YC_IAM_TOKEN environment variable
+	AuthModeIAMToken = "iam_token"
+	// AuthModeIAMTokenFile reads IAM token from the file rotated by an external agent
+	AuthModeIAMTokenFile = "iam_token_file"
+
+	// iamTokenEnv is the environment variable with IAM token used if iam_token option is not set
+	iamTokenEnv = "YC_IAM_TOKEN"
+
+	metadataRequestTimeout      = time.Second * 5
+	iamTokenFileRefreshInterval = time.Minute
+)
+
+type iamKey struct {
+	ServiceAccountID string `json:"service_account_id"`
+	ID               string `json:"id"`
+	PrivateKey       string `json:"private_key"`
+}
+
+// loadServiceAccountKey loads the service account key either from the authorized key file created by
+// `yc iam key create` or from key_id, service_account_id and PEM private key file options.
+func loadServiceAccountKey(config OutputPluginConfig) (*iamkey.Key, error) {
+	if config.AuthorizedKeyFilePath == "" {
+		return loadPEMServiceAccountKey(config)
+	}
+
+	data, err := ioutil.ReadFile(config.AuthorizedKeyFilePath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := iamkey.ReadFromJSONBytes(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse authorized key file `%s`", config.AuthorizedKeyFilePath)
+	}
+	if key.GetId() == "" {
+		return nil, errors.Wrapf(ErrFieldRequired, "id of authorized key file `%s`", config.AuthorizedKeyFilePath)
+	}
+	if key.GetServiceAccountId() == "" {
+		return nil, errors.Wrapf(ErrFieldRequired, "service_account_id of authorized key file `%s`", config.AuthorizedKeyFilePath)
+	}
+	if key.GetPrivateKey() == "" {
+		return nil, errors.Wrapf(ErrFieldRequired, "private_key of authorized key file `%s`", config.AuthorizedKeyFilePath)
+	}
+	return key, nil
+}
+
+func loadPEMServiceAccountKey(config OutputPluginConfig) (*iamkey.Key, error) {
+	privateBuffer, err := ioutil.ReadFile(config.PrivateKeyFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	ikey := &iamKey{
+		ServiceAccountID: config.ServiceAccountID,
+		ID:               config.KeyID,
+		PrivateKey:       string(privateBuffer),
+	}
+
+	iKeyBytes, err := json.Marshal(ikey)
+	if err != nil {
+		return nil, err
+	}
+
+	return iamkey.ReadFromJSONBytes(iKeyBytes)
+}
+
+// newCredentials returns SDK credentials of the configured auth_mode
+func newCredentials(config OutputPluginConfig) (ycsdk.Credentials, error) {
+	switch config.AuthMode {
+	case "", AuthModeServiceAccountKey:
+		key, err := loadServiceAccountKey(config)
+		if err != nil {
+			return nil, err
+		}
+		return ycsdk.ServiceAccountKey(key)
+	}
+	return newIAMTokenCredentials(config)
+}
+
+// newIAMTokenCredentials returns credentials that provide IAM token without exchanging service account key
+func newIAMTokenCredentials(config OutputPluginConfig) (ycsdk.NonExchangeableCredentials, error) {
+	switch config.AuthMode {
+	case AuthModeMetadata:
+		if config.MetadataAddr == "" || config.MetadataAddr == ycsdk.InstanceMetadataAddr {
+			return ycsdk.InstanceServiceAccount(), nil
+		}
+		return newMetadataCredentials(config.MetadataAddr), nil
+	case AuthModeIAMToken:
+		return ycsdk.NewIAMTokenCredentials(config.IAMToken), nil
+	case AuthModeIAMTokenFile:
+		return &iamTokenFileCredentials{path: config.IAMTokenFile}, nil
+	}
+	return nil, errors.Wrapf(ErrInvalidValue, "auth_mode `%s` doesn't provide iam token", config.AuthMode)
+}
+
+// metadataCredentials gets IAM token of the service account linked to the compute instance from the metadata
+// service at non-default metadata_addr, ycsdk.InstanceServiceAccount is used for the default address.
+type metadataCredentials struct {
+	addr   string
+	client http.Client
+}
+
+func newMetadataCredentials(addr string) *metadataCredentials {
+	return &metadataCredentials{
+		addr: addr,
+		client: http.Client{
+			Timeout: metadataRequestTimeout,
+		},
+	}
+}
+
+func (c *metadataCredentials) YandexCloudAPICredentials() {}
+
+func (c *metadataCredentials) IAMToken(ctx context.Context) (*iampb.CreateIamTokenResponse, error) {
+	url := fmt.Sprintf("http://%s/computeMetadata/v1/instance/service-accounts/default/token", c.addr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get iam token from metadata service %s", url)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read metadata service response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("an error occure while getting iam token from metadata service: status_code: %d, body:%s", resp.StatusCode, body)
+	}
+
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return nil, errors.Wrapf(err, "unable to unmarshal metadata service token response")
+	}
+	if tokenResponse.AccessToken == "" {
+		return nil, errors.New("metadata service returned empty iam token")
+	}
+
+	// token is considered expired a second earlier to not use it on the edge of expiration
+	expiresAt := time.Now().Add(time.Duration(tokenResponse.ExpiresIn-1) * time.Second)
+	return &iampb.CreateIamTokenResponse{
+		IamToken:  tokenResponse.AccessToken,
+		ExpiresAt: timestamppb.New(expiresAt),
+	}, nil
+}
+
+// iamTokenFileCredentials reads IAM token from the file rotated by an external agent. The file is re-read
+// every iamTokenFileRefreshInterval to pick up a new token.
+type iamTokenFileCredentials struct {
+	path string
+}
+
+func (c *iamTokenFileCredentials) YandexCloudAPICredentials() {}
+
+func (c *iamTokenFileCredentials) IAMToken(_ context.Context) (*iampb.CreateIamTokenResponse, error) {
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("iam token file `%s` is empty", c.path)
+	}
+	return &iampb.CreateIamTokenResponse{
+		IamToken:  token,
+		ExpiresAt: timestamppb.New(time.Now().Add(iamTokenFileRefreshInterval)),
+	}, nil
+}
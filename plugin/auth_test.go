@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ycsdk "github.com/yandex-cloud/go-sdk"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newFakeMetadataServer starts metadata service returning the given token of the instance service account
+func newFakeMetadataServer(t *testing.T, token string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": token,
+			"expires_in":   3600,
+			"token_type":   "Bearer",
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func metadataAddr(t *testing.T, server *httptest.Server) string {
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	return u.Host
+}
+
+func Test_LoadServiceAccountKey_AuthorizedKeyFile(t *testing.T) {
+	pem, err := ioutil.ReadFile("testdata/test_private.pem")
+	require.NoError(t, err)
+
+	key, err := loadServiceAccountKey(OutputPluginConfig{AuthorizedKeyFilePath: "testdata/test_authorized_key.json"})
+	require.NoError(t, err)
+	assert.Equal(t, "test_key_id", key.GetId())
+	assert.Equal(t, "test_service_account_id", key.GetServiceAccountId())
+	assert.Equal(t, string(pem), key.GetPrivateKey())
+}
+
+func Test_LoadServiceAccountKey_PrivateKeyFile(t *testing.T) {
+	key, err := loadServiceAccountKey(OutputPluginConfig{
+		KeyID:              "test_key_id",
+		ServiceAccountID:   "test_service_account_id",
+		PrivateKeyFilePath: "testdata/test_private.pem",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "test_key_id", key.GetId())
+	assert.Equal(t, "test_service_account_id", key.GetServiceAccountId())
+}
+
+func Test_LoadServiceAccountKey_InvalidAuthorizedKeyFile(t *testing.T) {
+	_, err := loadServiceAccountKey(OutputPluginConfig{AuthorizedKeyFilePath: "not_existed_key.json"})
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	withoutAccount := filepath.Join(t.TempDir(), "key.json")
+	require.NoError(t, ioutil.WriteFile(withoutAccount, []byte(`{"id": "test_key_id", "private_key": "key"}`), 0600))
+	_, err = loadServiceAccountKey(OutputPluginConfig{AuthorizedKeyFilePath: withoutAccount})
+	assert.True(t, errors.Is(err, ErrFieldRequired))
+}
+
+func Test_MetadataCredentials(t *testing.T) {
+	server := newFakeMetadataServer(t, "test_metadata_token")
+	credentials, err := newIAMTokenCredentials(OutputPluginConfig{
+		AuthMode:     AuthModeMetadata,
+		MetadataAddr: metadataAddr(t, server),
+	})
+	require.NoError(t, err)
+
+	resp, err := credentials.IAMToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "test_metadata_token", resp.GetIamToken())
+	assert.WithinDuration(t, time.Now().Add(time.Hour), resp.GetExpiresAt().AsTime(), time.Second*5)
+}
+
+func Test_MetadataCredentials_DefaultAddr(t *testing.T) {
+	for _, addr := range []string{"", ycsdk.InstanceMetadataAddr} {
+		credentials, err := newIAMTokenCredentials(OutputPluginConfig{AuthMode: AuthModeMetadata, MetadataAddr: addr})
+		require.NoError(t, err)
+		_, custom := credentials.(*metadataCredentials)
+		assert.False(t, custom, "sdk credentials should be used for the default metadata address `%s`", addr)
+	}
+}
+
+func Test_MetadataCredentials_Unavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := newMetadataCredentials(metadataAddr(t, server)).IAMToken(context.Background())
+	assert.Error(t, err)
+}
+
+func Test_IAMTokenFileCredentials(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("test_token_1\n"), 0600))
+	credentials, err := newIAMTokenCredentials(OutputPluginConfig{AuthMode: AuthModeIAMTokenFile, IAMTokenFile: tokenFile})
+	require.NoError(t, err)
+
+	resp, err := credentials.IAMToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "test_token_1", resp.GetIamToken())
+
+	// token rotated by an external agent is picked up
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("test_token_2"), 0600))
+	resp, err = credentials.IAMToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "test_token_2", resp.GetIamToken())
+
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte(" "), 0600))
+	_, err = credentials.IAMToken(context.Background())
+	assert.Error(t, err, "empty token file should fail")
+}
+
+func Test_IAMTokenCredentials(t *testing.T) {
+	credentials, err := newIAMTokenCredentials(OutputPluginConfig{AuthMode: AuthModeIAMToken, IAMToken: "test_static_token"})
+	require.NoError(t, err)
+
+	resp, err := credentials.IAMToken(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "test_static_token", resp.GetIamToken())
+}
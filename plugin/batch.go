@@ -0,0 +1,57 @@
+package plugin
+
+// batchRange is a half-open [start, end) range of entries sent within one request
+type batchRange struct {
+	start int
+	end   int
+}
+
+// splitBatches splits count entries into consecutive ranges holding at most maxEntries entries
+// and at most maxBytes bytes in total, as reported by sizeOf. An entry which is larger than
+// maxBytes on its own is put into a separate batch. Non-positive limits are not enforced.
+func splitBatches(count int, sizeOf func(idx int) int, maxEntries, maxBytes int) []batchRange {
+	var batches []batchRange
+	start, batchBytes := 0, 0
+	for idx := 0; idx < count; idx++ {
+		size := sizeOf(idx)
+		entriesExceeded := maxEntries > 0 && idx-start >= maxEntries
+		bytesExceeded := maxBytes > 0 && idx > start && batchBytes+size > maxBytes
+		if entriesExceeded || bytesExceeded {
+			batches = append(batches, batchRange{start: start, end: idx})
+			start, batchBytes = idx, 0
+		}
+		batchBytes += size
+	}
+	if start < count {
+		batches = append(batches, batchRange{start: start, end: count})
+	}
+	return batches
+}
+
+// estimateRecordSize returns the approximate size of the record, counting lengths of keys and string values
+// and 8 bytes for other values
+func estimateRecordSize(record map[interface{}]interface{}) int {
+	size := 0
+	for k, v := range record {
+		size += estimateValueSize(k) + estimateValueSize(v)
+	}
+	return size
+}
+
+func estimateValueSize(v interface{}) int {
+	switch t := v.(type) {
+	case string:
+		return len(t)
+	case []byte:
+		return len(t)
+	case map[interface{}]interface{}:
+		return estimateRecordSize(t)
+	case []interface{}:
+		size := 0
+		for _, item := range t {
+			size += estimateValueSize(item)
+		}
+		return size
+	}
+	return 8
+}
@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_SplitBatches(t *testing.T) {
+	cases := []struct {
+		name       string
+		sizes      []int
+		maxEntries int
+		maxBytes   int
+		expected   []batchRange
+	}{
+		{
+			name:       "empty",
+			sizes:      nil,
+			maxEntries: 10,
+			maxBytes:   100,
+			expected:   nil,
+		},
+		{
+			name:       "fits_one_batch",
+			sizes:      []int{10, 10, 10},
+			maxEntries: 10,
+			maxBytes:   100,
+			expected:   []batchRange{{0, 3}},
+		},
+		{
+			name:       "entries_limit",
+			sizes:      []int{1, 1, 1, 1, 1},
+			maxEntries: 2,
+			maxBytes:   100,
+			expected:   []batchRange{{0, 2}, {2, 4}, {4, 5}},
+		},
+		{
+			name:       "bytes_limit",
+			sizes:      []int{40, 40, 40, 10, 60},
+			maxEntries: 10,
+			maxBytes:   100,
+			expected:   []batchRange{{0, 2}, {2, 4}, {4, 5}},
+		},
+		{
+			name:       "oversized_entry_goes_alone",
+			sizes:      []int{10, 500, 10},
+			maxEntries: 10,
+			maxBytes:   100,
+			expected:   []batchRange{{0, 1}, {1, 2}, {2, 3}},
+		},
+		{
+			name:       "no_limits",
+			sizes:      []int{1000, 1000, 1000},
+			maxEntries: 0,
+			maxBytes:   0,
+			expected:   []batchRange{{0, 3}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			batches := splitBatches(len(c.sizes), func(idx int) int { return c.sizes[idx] }, c.maxEntries, c.maxBytes)
+			assert.Equal(t, c.expected, batches)
+		})
+	}
+}
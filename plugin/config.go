@@ -4,90 +4,791 @@ import (
 	fluentbit "github.com/fluent/fluent-bit-go/output"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	ycsdk "github.com/yandex-cloud/go-sdk"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 	"unsafe"
 )
 
 var ErrFieldRequired = errors.New("Field required")
 var ErrOneOfFieldsRequired = errors.New("One of the given fields are required")
+var ErrInvalidValue = errors.New("Invalid field value")
+var ErrMutuallyExclusiveFields = errors.New("Fields are mutually exclusive")
+
+const (
+	// TransportGRPC sends logs with gRPC ingestion API
+	TransportGRPC = "grpc"
+	// TransportHTTP sends logs with REST ingestion API
+	TransportHTTP = "http"
+
+	defaultGRPCEndpointUrl = "ingester.logging.yandexcloud.net:443"
+	defaultHTTPEndpointUrl = "https://ingester.logging.yandexcloud.net/logging/v1/write"
+	defaultIAMEndpointUrl  = "https://iam.api.cloud.yandex.net/iam/v1/tokens"
+
+	defaultMaxRequestEntries = 100
+	defaultMaxRequestBytes   = 3 * 1024 * 1024
+
+	defaultShutdownTimeout = time.Second * 10
+
+	defaultRequestTimeout = time.Second * 5
+	defaultTokenLifetime  = time.Minute * 5
+	// maxTokenLifetime is the lifetime of IAM token, it is refreshed before the expiration
+	maxTokenLifetime = time.Hour * 12
+
+	defaultSpoolReplayInterval = time.Second * 5
+
+	defaultRetryMaxAttempts = 3
+	defaultRetryBaseDelay   = time.Millisecond * 200
+	defaultRetryMaxDelay    = time.Second * 5
+	defaultRetryJitter      = 0.2
+)
+
+// configKeyGetter returns raw value of the plugin option with the given name
+type configKeyGetter func(key string) string
 
 type OutputPluginConfig struct {
-	PluginInstanceId   int
-	EndpointUrl        string
-	LogGroupId         string
-	FolderId           string
-	ResourceId         string
-	ResourceType       string
-	KeyID              string
-	ServiceAccountID   string
-	PrivateKeyFilePath string
-	LogLevelKey        string
+	PluginInstanceId      int
+	Transport             string
+	EndpointUrl           string
+	IAMEndpointUrl        string
+	LogGroupId            string
+	FolderId              string
+	LogGroupIdKey         recordAccessor
+	FolderIdKey           recordAccessor
+	TagLogGroupMap        []tagRoute
+	ResourceId            string
+	ResourceType          string
+	ResourceIdKey         recordAccessor
+	ResourceTypeKey       recordAccessor
+	StreamName            string
+	StreamNameKey         recordAccessor
+	StreamNameFromTag     bool
+	AuthMode              string
+	MetadataAddr          string
+	IAMToken              string
+	IAMTokenFile          string
+	KeyID                 string
+	ServiceAccountID      string
+	PrivateKeyFilePath    string
+	AuthorizedKeyFilePath string
+	LogLevelKey           string
+	LevelMap              map[string]logging.LogLevel_Level
+	DefaultLevel          logging.LogLevel_Level
+	DefaultPayload        *structpb.Struct
+	MessageKeys           []string
+	MessageTemplate       string
+	MessageKeepFields     bool
+	PayloadKey            recordAccessor
+	IncludeKeys           []recordAccessor
+	ExcludeKeys           []recordAccessor
+	RedactKeys            []*regexp.Regexp
+	RedactValues          []*regexp.Regexp
+	RedactMode            string
+	RedactMask            string
+	RedactHashSalt        string
+	TimeKey               string
+	TimeFormat            string
+	MaxRequestEntries     int
+	MaxRequestBytes       int
+
+	PartialFailurePolicy    string
+	RejectedEntriesFallback string
+
+	DeadLetterPath     string
+	DeadLetterMaxBytes int
+	DeadLetterMaxFiles int
+
+	RetryMaxAttempts int
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+	RetryJitter      float64
+
+	ShutdownTimeout time.Duration
+
+	RequestTimeout time.Duration
+	ConnectTimeout time.Duration
+	TokenLifetime  time.Duration
+
+	BatchMaxEntries int
+	BatchMaxBytes   int
+	BatchMaxWait    time.Duration
+
+	RateLimitEntries  int
+	RateLimitBytes    int
+	RateLimitAdaptive bool
+
+	SpoolDir            string
+	SpoolMaxBytes       int
+	SpoolSegmentBytes   int
+	SpoolFsync          string
+	SpoolReplayInterval time.Duration
+
+	MetricsListen string
+
+	Async             bool
+	AsyncQueueSize    int
+	AsyncWorkers      int
+	AsyncBackpressure string
 }
 
-func NewOutputPluginConfig(ctx unsafe.Pointer, pluginID int) OutputPluginConfig {
+func NewOutputPluginConfig(ctx unsafe.Pointer, pluginID int) (OutputPluginConfig, error) {
+	return newOutputPluginConfig(func(key string) string {
+		return fluentbit.FLBPluginConfigKey(ctx, key)
+	}, pluginID)
+}
+
+func newOutputPluginConfig(getConfigKey configKeyGetter, pluginID int) (OutputPluginConfig, error) {
+	var err error
 	config := OutputPluginConfig{}
 	config.PluginInstanceId = pluginID
 
-	config.EndpointUrl = fluentbit.FLBPluginConfigKey(ctx, "endpoint_url")
+	config.Transport = strings.ToLower(getConfigKey("transport"))
+	if config.Transport == "" {
+		config.Transport = TransportGRPC
+	}
+	log.Infof("[yandexcloud %d] plugin parameter transport = `%s`", pluginID, config.Transport)
+
+	config.EndpointUrl = getConfigKey("endpoint_url")
 	if config.EndpointUrl == "" {
-		config.EndpointUrl = "ingester.logging.yandexcloud.net:443"
+		config.EndpointUrl = defaultGRPCEndpointUrl
+		if config.Transport == TransportHTTP {
+			config.EndpointUrl = defaultHTTPEndpointUrl
+		}
 	}
 	log.Infof("[yandexcloud %d] plugin parameter endpoint_url = `%s`", pluginID, config.EndpointUrl)
 
-	config.LogGroupId = fluentbit.FLBPluginConfigKey(ctx, "log_group_id")
+	config.IAMEndpointUrl = getConfigKey("iam_endpoint_url")
+	if config.IAMEndpointUrl == "" {
+		config.IAMEndpointUrl = defaultIAMEndpointUrl
+	}
+	log.Infof("[yandexcloud %d] plugin parameter iam_endpoint_url = `%s`", pluginID, config.IAMEndpointUrl)
+
+	config.LogGroupId = getConfigKey("log_group_id")
 	log.Infof("[yandexcloud %d] plugin parameter log_group_id = `%s`", pluginID, config.LogGroupId)
 
-	config.FolderId = fluentbit.FLBPluginConfigKey(ctx, "folder_id")
+	config.FolderId = getConfigKey("folder_id")
 	log.Infof("[yandexcloud %d] plugin parameter folder_id = `%s`", pluginID, config.FolderId)
 
-	config.ResourceId = fluentbit.FLBPluginConfigKey(ctx, "resource_id")
+	config.LogGroupIdKey, err = parseRecordAccessor(getConfigKey("log_group_id_key"))
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter log_group_id_key = `%s`", pluginID, config.LogGroupIdKey)
+
+	config.FolderIdKey, err = parseRecordAccessor(getConfigKey("folder_id_key"))
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter folder_id_key = `%s`", pluginID, config.FolderIdKey)
+
+	tagLogGroupMap := getConfigKey("tag_log_group_map")
+	config.TagLogGroupMap, err = parseTagLogGroupMap(tagLogGroupMap)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter tag_log_group_map = `%s`", pluginID, tagLogGroupMap)
+
+	config.ResourceId = getConfigKey("resource_id")
 	log.Infof("[yandexcloud %d] plugin parameter resource_id = `%s`", pluginID, config.ResourceId)
 
-	config.ResourceType = fluentbit.FLBPluginConfigKey(ctx, "resource_type")
+	config.ResourceType = getConfigKey("resource_type")
 	log.Infof("[yandexcloud %d] plugin parameter resource_type = `%s`", pluginID, config.ResourceType)
 
-	config.KeyID = fluentbit.FLBPluginConfigKey(ctx, "key_id")
+	config.ResourceIdKey, err = parseRecordAccessor(getConfigKey("resource_id_key"))
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter resource_id_key = `%s`", pluginID, config.ResourceIdKey)
+
+	config.ResourceTypeKey, err = parseRecordAccessor(getConfigKey("resource_type_key"))
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter resource_type_key = `%s`", pluginID, config.ResourceTypeKey)
+
+	config.StreamName = getConfigKey("stream_name")
+	log.Infof("[yandexcloud %d] plugin parameter stream_name = `%s`", pluginID, config.StreamName)
+
+	streamNameKey := getConfigKey("stream_name_key")
+	if strings.EqualFold(strings.TrimSpace(streamNameKey), StreamNameKeyTag) {
+		config.StreamNameFromTag = true
+	} else if config.StreamNameKey, err = parseRecordAccessor(streamNameKey); err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter stream_name_key = `%s`", pluginID, streamNameKey)
+
+	config.AuthMode = strings.ToLower(getConfigKey("auth_mode"))
+	if config.AuthMode == "" {
+		config.AuthMode = AuthModeServiceAccountKey
+	}
+	log.Infof("[yandexcloud %d] plugin parameter auth_mode = `%s`", pluginID, config.AuthMode)
+
+	config.MetadataAddr = getConfigKey("metadata_addr")
+	if config.MetadataAddr == "" {
+		config.MetadataAddr = ycsdk.InstanceMetadataAddr
+	}
+	log.Infof("[yandexcloud %d] plugin parameter metadata_addr = `%s`", pluginID, config.MetadataAddr)
+
+	// the token is a secret, so only its presence is logged
+	config.IAMToken = getConfigKey("iam_token")
+	if config.IAMToken == "" {
+		config.IAMToken = os.Getenv(iamTokenEnv)
+	}
+	log.Infof("[yandexcloud %d] plugin parameter iam_token is set = `%t`", pluginID, config.IAMToken != "")
+
+	config.IAMTokenFile = getConfigKey("iam_token_file")
+	log.Infof("[yandexcloud %d] plugin parameter iam_token_file = `%s`", pluginID, config.IAMTokenFile)
+
+	config.KeyID = getConfigKey("key_id")
 	log.Infof("[yandexcloud %d] plugin parameter key_id = `%s`", pluginID, config.KeyID)
 
-	config.ServiceAccountID = fluentbit.FLBPluginConfigKey(ctx, "service_account_id")
+	config.ServiceAccountID = getConfigKey("service_account_id")
 	log.Infof("[yandexcloud %d] plugin parameter service_account_id = `%s`", pluginID, config.ServiceAccountID)
 
-	config.PrivateKeyFilePath = fluentbit.FLBPluginConfigKey(ctx, "private_key_file_path")
+	config.PrivateKeyFilePath = getConfigKey("private_key_file_path")
 	log.Infof("[yandexcloud %d] plugin parameter private_key_file_path = `%s`", pluginID, config.PrivateKeyFilePath)
 
-	config.LogLevelKey = fluentbit.FLBPluginConfigKey(ctx, "log_level_key")
+	config.AuthorizedKeyFilePath = getConfigKey("authorized_key_file")
+	log.Infof("[yandexcloud %d] plugin parameter authorized_key_file = `%s`", pluginID, config.AuthorizedKeyFilePath)
+
+	config.LogLevelKey = getConfigKey("log_level_key")
 	if config.LogLevelKey == "" {
 		config.LogLevelKey = "level"
 	}
 	log.Infof("[yandexcloud %d] plugin parameter log_level_key = `%s`", pluginID, config.LogLevelKey)
 
-	return config
+	levelMap := getConfigKey("level_map")
+	config.LevelMap, err = parseLevelMap(levelMap)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter level_map = `%s`", pluginID, levelMap)
+
+	defaultLevel := getConfigKey("default_level")
+	if defaultLevel != "" {
+		config.DefaultLevel = newLevelMapper(config.LevelMap).Map(defaultLevel)
+		if config.DefaultLevel == logging.LogLevel_LEVEL_UNSPECIFIED {
+			return config, errors.Wrapf(ErrInvalidValue, "default_level has unknown level `%s`", defaultLevel)
+		}
+	}
+	log.Infof("[yandexcloud %d] plugin parameter default_level = `%s`", pluginID, config.DefaultLevel)
+
+	defaultPayload := getConfigKey("default_payload")
+	config.DefaultPayload, err = parseDefaultPayload(defaultPayload)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter default_payload = `%s`", pluginID, defaultPayload)
+
+	config.MessageKeys = parseListConfigKey(getConfigKey, "message_key")
+	if len(config.MessageKeys) == 0 {
+		config.MessageKeys = []string{"message"}
+	}
+	log.Infof("[yandexcloud %d] plugin parameter message_key = `%s`", pluginID, strings.Join(config.MessageKeys, ","))
+
+	config.MessageTemplate = getConfigKey("message_template")
+	if _, err = newMessageBuilder(config); err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter message_template = `%s`", pluginID, config.MessageTemplate)
+
+	config.MessageKeepFields, err = parseBoolConfigKey(getConfigKey, "message_keep_fields", false)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter message_keep_fields = `%t`", pluginID, config.MessageKeepFields)
+
+	config.PayloadKey, err = parseRecordAccessor(getConfigKey("payload_key"))
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter payload_key = `%s`", pluginID, config.PayloadKey)
+
+	config.IncludeKeys, err = parseRecordAccessorList(getConfigKey, "include_keys")
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter include_keys = `%s`", pluginID, getConfigKey("include_keys"))
+
+	config.ExcludeKeys, err = parseRecordAccessorList(getConfigKey, "exclude_keys")
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter exclude_keys = `%s`", pluginID, getConfigKey("exclude_keys"))
+
+	config.RedactKeys, err = parseRedactKeys(getConfigKey)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter redact_keys = `%s`", pluginID, getConfigKey("redact_keys"))
+
+	config.RedactValues, err = parseRedactValues(getConfigKey)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter redact_values = `%s`", pluginID, getConfigKey("redact_values"))
+	log.Infof("[yandexcloud %d] plugin parameter redact_value_regex = `%s`", pluginID, getConfigKey("redact_value_regex"))
+
+	config.RedactMode = strings.ToLower(getConfigKey("redact_mode"))
+	if config.RedactMode == "" {
+		config.RedactMode = RedactModeMask
+	}
+	log.Infof("[yandexcloud %d] plugin parameter redact_mode = `%s`", pluginID, config.RedactMode)
+
+	config.RedactMask = getConfigKey("redact_mask")
+	if config.RedactMask == "" {
+		config.RedactMask = defaultRedactMask
+	}
+	log.Infof("[yandexcloud %d] plugin parameter redact_mask = `%s`", pluginID, config.RedactMask)
+
+	// the salt is a secret, so only its presence is logged
+	config.RedactHashSalt = getConfigKey("redact_hash_salt")
+	log.Infof("[yandexcloud %d] plugin parameter redact_hash_salt is set = `%t`", pluginID, config.RedactHashSalt != "")
+
+	config.TimeKey = getConfigKey("time_key")
+	log.Infof("[yandexcloud %d] plugin parameter time_key = `%s`", pluginID, config.TimeKey)
+
+	config.TimeFormat = getConfigKey("time_format")
+	if config.TimeFormat == "" {
+		config.TimeFormat = time.RFC3339Nano
+	}
+	log.Infof("[yandexcloud %d] plugin parameter time_format = `%s`", pluginID, config.TimeFormat)
+
+	config.MaxRequestEntries, err = parseIntConfigKey(getConfigKey, "max_request_entries", defaultMaxRequestEntries)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter max_request_entries = `%d`", pluginID, config.MaxRequestEntries)
+
+	config.MaxRequestBytes, err = parseIntConfigKey(getConfigKey, "max_request_bytes", defaultMaxRequestBytes)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter max_request_bytes = `%d`", pluginID, config.MaxRequestBytes)
+
+	config.PartialFailurePolicy = getConfigKey("partial_failure_policy")
+	if config.PartialFailurePolicy == "" {
+		config.PartialFailurePolicy = PartialFailurePolicyIgnore
+	}
+	log.Infof("[yandexcloud %d] plugin parameter partial_failure_policy = `%s`", pluginID, config.PartialFailurePolicy)
+
+	config.DeadLetterPath = getConfigKey("dead_letter_path")
+	log.Infof("[yandexcloud %d] plugin parameter dead_letter_path = `%s`", pluginID, config.DeadLetterPath)
+
+	config.DeadLetterMaxBytes, err = parseIntConfigKey(getConfigKey, "dead_letter_max_bytes", defaultDeadLetterMaxBytes)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter dead_letter_max_bytes = `%d`", pluginID, config.DeadLetterMaxBytes)
+
+	config.DeadLetterMaxFiles, err = parseIntConfigKey(getConfigKey, "dead_letter_max_files", defaultDeadLetterMaxFiles)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter dead_letter_max_files = `%d`", pluginID, config.DeadLetterMaxFiles)
+
+	config.RejectedEntriesFallback = getConfigKey("rejected_entries_fallback")
+	if config.RejectedEntriesFallback == "" {
+		config.RejectedEntriesFallback = RejectedFallbackLog
+		if config.DeadLetterPath != "" {
+			config.RejectedEntriesFallback = RejectedFallbackDeadLetter
+		}
+	}
+	log.Infof("[yandexcloud %d] plugin parameter rejected_entries_fallback = `%s`", pluginID, config.RejectedEntriesFallback)
+
+	config.RetryMaxAttempts, err = parseIntConfigKey(getConfigKey, "retry_max_attempts", defaultRetryMaxAttempts)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter retry_max_attempts = `%d`", pluginID, config.RetryMaxAttempts)
+
+	config.RetryBaseDelay, err = parseDurationConfigKey(getConfigKey, "retry_base_delay", defaultRetryBaseDelay)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter retry_base_delay = `%s`", pluginID, config.RetryBaseDelay)
+
+	config.RetryMaxDelay, err = parseDurationConfigKey(getConfigKey, "retry_max_delay", defaultRetryMaxDelay)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter retry_max_delay = `%s`", pluginID, config.RetryMaxDelay)
+
+	config.RetryJitter = defaultRetryJitter
+	if raw := getConfigKey("retry_jitter"); raw != "" {
+		config.RetryJitter, err = strconv.ParseFloat(raw, 64)
+		if err != nil || config.RetryJitter < 0 || config.RetryJitter > 1 {
+			return config, errors.Wrapf(ErrInvalidValue, "retry_jitter must be a number between 0 and 1, got `%s`", raw)
+		}
+	}
+	log.Infof("[yandexcloud %d] plugin parameter retry_jitter = `%g`", pluginID, config.RetryJitter)
+
+	config.ShutdownTimeout, err = parseDurationConfigKey(getConfigKey, "shutdown_timeout", defaultShutdownTimeout)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter shutdown_timeout = `%s`", pluginID, config.ShutdownTimeout)
+
+	config.RequestTimeout, err = parseDurationConfigKey(getConfigKey, "request_timeout", defaultRequestTimeout)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter request_timeout = `%s`", pluginID, config.RequestTimeout)
+
+	config.ConnectTimeout, err = parseDurationConfigKey(getConfigKey, "connect_timeout", 0)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter connect_timeout = `%s`", pluginID, config.ConnectTimeout)
+
+	config.TokenLifetime, err = parseDurationConfigKey(getConfigKey, "token_lifetime", defaultTokenLifetime)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter token_lifetime = `%s`", pluginID, config.TokenLifetime)
+	if getConfigKey("token_lifetime") != "" && config.Transport != TransportHTTP {
+		log.Warnf("[yandexcloud %d] token_lifetime is used by `%s` transport only, IAM token of `%s` transport is refreshed by the SDK",
+			pluginID, TransportHTTP, config.Transport)
+	}
+
+	config.BatchMaxEntries, err = parseIntConfigKey(getConfigKey, "batch_max_entries", 0)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter batch_max_entries = `%d`", pluginID, config.BatchMaxEntries)
+
+	config.BatchMaxBytes, err = parseIntConfigKey(getConfigKey, "batch_max_bytes", 0)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter batch_max_bytes = `%d`", pluginID, config.BatchMaxBytes)
+
+	config.BatchMaxWait, err = parseDurationConfigKey(getConfigKey, "batch_max_wait", 0)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter batch_max_wait = `%s`", pluginID, config.BatchMaxWait)
+
+	config.RateLimitEntries, err = parseIntConfigKey(getConfigKey, "rate_limit_entries", 0)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter rate_limit_entries = `%d`", pluginID, config.RateLimitEntries)
+
+	config.RateLimitBytes, err = parseIntConfigKey(getConfigKey, "rate_limit_bytes", 0)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter rate_limit_bytes = `%d`", pluginID, config.RateLimitBytes)
+
+	config.RateLimitAdaptive, err = parseBoolConfigKey(getConfigKey, "rate_limit_adaptive", false)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter rate_limit_adaptive = `%t`", pluginID, config.RateLimitAdaptive)
+
+	config.SpoolDir = getConfigKey("spool_dir")
+	log.Infof("[yandexcloud %d] plugin parameter spool_dir = `%s`", pluginID, config.SpoolDir)
+
+	config.SpoolMaxBytes, err = parseIntConfigKey(getConfigKey, "spool_max_bytes", defaultSpoolMaxBytes)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter spool_max_bytes = `%d`", pluginID, config.SpoolMaxBytes)
+
+	config.SpoolSegmentBytes, err = parseIntConfigKey(getConfigKey, "spool_segment_bytes", defaultSpoolSegmentBytes)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter spool_segment_bytes = `%d`", pluginID, config.SpoolSegmentBytes)
+
+	config.SpoolFsync = strings.ToLower(getConfigKey("spool_fsync"))
+	if config.SpoolFsync == "" {
+		config.SpoolFsync = SpoolFsyncAlways
+	}
+	log.Infof("[yandexcloud %d] plugin parameter spool_fsync = `%s`", pluginID, config.SpoolFsync)
+
+	config.SpoolReplayInterval, err = parseDurationConfigKey(getConfigKey, "spool_replay_interval", defaultSpoolReplayInterval)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter spool_replay_interval = `%s`", pluginID, config.SpoolReplayInterval)
+
+	config.MetricsListen = getConfigKey("metrics_listen")
+	log.Infof("[yandexcloud %d] plugin parameter metrics_listen = `%s`", pluginID, config.MetricsListen)
+
+	config.Async, err = parseBoolConfigKey(getConfigKey, "async", false)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter async = `%t`", pluginID, config.Async)
+
+	config.AsyncQueueSize, err = parseIntConfigKey(getConfigKey, "async_queue_size", defaultAsyncQueueSize)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter async_queue_size = `%d`", pluginID, config.AsyncQueueSize)
+
+	config.AsyncWorkers, err = parseIntConfigKey(getConfigKey, "async_workers", defaultAsyncWorkers)
+	if err != nil {
+		return config, err
+	}
+	log.Infof("[yandexcloud %d] plugin parameter async_workers = `%d`", pluginID, config.AsyncWorkers)
+
+	config.AsyncBackpressure = strings.ToLower(getConfigKey("async_backpressure"))
+	if config.AsyncBackpressure == "" {
+		config.AsyncBackpressure = AsyncBackpressureBlock
+	}
+	log.Infof("[yandexcloud %d] plugin parameter async_backpressure = `%s`", pluginID, config.AsyncBackpressure)
+
+	return config, nil
+}
+
+// parseDefaultPayload parses default_payload option value which is a JSON object
+func parseDefaultPayload(raw string) (*structpb.Struct, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	payload := &structpb.Struct{}
+	if err := protojson.Unmarshal([]byte(raw), payload); err != nil {
+		return nil, errors.Wrapf(ErrInvalidValue, "default_payload must be a JSON object: %v", err)
+	}
+	return payload, nil
+}
+
+// parseIntConfigKey parses the option as a positive integer, returning defaultValue if the option is not set
+func parseIntConfigKey(getConfigKey configKeyGetter, key string, defaultValue int) (int, error) {
+	raw := getConfigKey(key)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value <= 0 {
+		return 0, errors.Wrapf(ErrInvalidValue, "%s must be a positive integer, got `%s`", key, raw)
+	}
+	return value, nil
+}
+
+// parseBoolConfigKey parses the option as a fluent-bit boolean, returning defaultValue if the option is not set
+func parseBoolConfigKey(getConfigKey configKeyGetter, key string, defaultValue bool) (bool, error) {
+	raw := getConfigKey(key)
+	switch strings.ToLower(raw) {
+	case "":
+		return defaultValue, nil
+	case "true", "on", "yes":
+		return true, nil
+	case "false", "off", "no":
+		return false, nil
+	}
+	return false, errors.Wrapf(ErrInvalidValue, "%s must be one of `on`, `off`, `true`, `false`, got `%s`", key, raw)
+}
+
+// parseListConfigKey splits the comma separated option into trimmed non-empty items
+func parseListConfigKey(getConfigKey configKeyGetter, key string) []string {
+	var items []string
+	for _, item := range strings.Split(getConfigKey(key), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseDurationConfigKey parses the option as a positive Go duration, returning defaultValue if the option is not set
+func parseDurationConfigKey(getConfigKey configKeyGetter, key string, defaultValue time.Duration) (time.Duration, error) {
+	raw := getConfigKey(key)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value <= 0 {
+		return 0, errors.Wrapf(ErrInvalidValue, "%s must be a positive duration like `500ms` or `2s`, got `%s`", key, raw)
+	}
+	return value, nil
 }
 
 func (config OutputPluginConfig) Validate() error {
 
+	switch config.Transport {
+	case "", TransportGRPC, TransportHTTP:
+	default:
+		return errors.Wrapf(ErrInvalidValue, "transport must be one of `%s`, `%s`", TransportGRPC, TransportHTTP)
+	}
+
 	if config.LogGroupId == "" && config.FolderId == "" {
 		return errors.Wrap(ErrOneOfFieldsRequired, "log_group_id or folder_id")
 	}
 
-	if config.ResourceId == "" {
-		return errors.Wrap(ErrFieldRequired, "resource_id")
+	if config.ResourceId == "" && !config.ResourceIdKey.IsSet() {
+		return errors.Wrap(ErrOneOfFieldsRequired, "resource_id or resource_id_key")
+	}
+
+	if config.ResourceType == "" && !config.ResourceTypeKey.IsSet() {
+		return errors.Wrap(ErrOneOfFieldsRequired, "resource_type or resource_type_key")
+	}
+
+	switch config.AuthMode {
+	case "", AuthModeServiceAccountKey:
+		if err := config.validateServiceAccountKey(); err != nil {
+			return err
+		}
+	case AuthModeMetadata:
+	case AuthModeIAMToken:
+		if config.IAMToken == "" {
+			return errors.Wrapf(ErrFieldRequired, "iam_token (or %s environment variable)", iamTokenEnv)
+		}
+	case AuthModeIAMTokenFile:
+		if config.IAMTokenFile == "" {
+			return errors.Wrap(ErrFieldRequired, "iam_token_file")
+		}
+	default:
+		return errors.Wrapf(ErrInvalidValue, "auth_mode must be one of `%s`, `%s`, `%s`, `%s`",
+			AuthModeServiceAccountKey, AuthModeMetadata, AuthModeIAMToken, AuthModeIAMTokenFile)
+	}
+
+	switch config.RedactMode {
+	case "", RedactModeMask:
+	case RedactModeHash:
+		if config.RedactHashSalt == "" {
+			return errors.Wrap(ErrFieldRequired, "redact_hash_salt for redact_mode `hash`")
+		}
+	default:
+		return errors.Wrapf(ErrInvalidValue, "redact_mode must be one of `%s`, `%s`", RedactModeMask, RedactModeHash)
+	}
+
+	switch config.PartialFailurePolicy {
+	case "", PartialFailurePolicyIgnore, PartialFailurePolicyRetry:
+	default:
+		return errors.Wrapf(ErrInvalidValue, "partial_failure_policy must be one of `%s`, `%s`",
+			PartialFailurePolicyIgnore, PartialFailurePolicyRetry)
+	}
+
+	switch config.RejectedEntriesFallback {
+	case "", RejectedFallbackLog, RejectedFallbackDrop:
+	case RejectedFallbackDeadLetter:
+		if config.DeadLetterPath == "" {
+			return errors.Wrapf(ErrFieldRequired, "dead_letter_path is required for rejected_entries_fallback `%s`", RejectedFallbackDeadLetter)
+		}
+	default:
+		return errors.Wrapf(ErrInvalidValue, "rejected_entries_fallback must be one of `%s`, `%s`, `%s`",
+			RejectedFallbackLog, RejectedFallbackDrop, RejectedFallbackDeadLetter)
+	}
+
+	if config.DeadLetterPath != "" {
+		if config.DeadLetterMaxBytes <= 0 {
+			return errors.Wrap(ErrInvalidValue, "dead_letter_max_bytes must be positive")
+		}
+		if config.DeadLetterMaxFiles < 0 {
+			return errors.Wrap(ErrInvalidValue, "dead_letter_max_files must not be negative")
+		}
+	}
+
+	switch config.SpoolFsync {
+	case "", SpoolFsyncAlways, SpoolFsyncSegment, SpoolFsyncNever:
+	default:
+		return errors.Wrapf(ErrInvalidValue, "spool_fsync must be one of `%s`, `%s`, `%s`",
+			SpoolFsyncAlways, SpoolFsyncSegment, SpoolFsyncNever)
+	}
+
+	if config.SpoolDir != "" && config.SpoolSegmentBytes > config.SpoolMaxBytes {
+		return errors.Wrap(ErrInvalidValue, "spool_segment_bytes must not be greater than spool_max_bytes")
+	}
+
+	if config.MetricsListen != "" {
+		if _, _, err := net.SplitHostPort(config.MetricsListen); err != nil {
+			return errors.Wrapf(ErrInvalidValue, "metrics_listen must look like `host:port` or `:port`: %v", err)
+		}
+	}
+
+	if config.RequestTimeout < 0 || config.ConnectTimeout < 0 || config.TokenLifetime < 0 {
+		return errors.Wrap(ErrInvalidValue, "request_timeout, connect_timeout and token_lifetime must not be negative")
+	}
+	if config.TokenLifetime > maxTokenLifetime {
+		return errors.Wrapf(ErrInvalidValue, "token_lifetime must not exceed IAM token lifetime %s, got %s", maxTokenLifetime, config.TokenLifetime)
+	}
+
+	if config.BatchMaxEntries < 0 || config.BatchMaxBytes < 0 || config.BatchMaxWait < 0 {
+		return errors.Wrap(ErrInvalidValue, "batch_max_entries, batch_max_bytes and batch_max_wait must not be negative")
+	}
+	if (config.BatchMaxEntries > 0 || config.BatchMaxBytes > 0) && config.BatchMaxWait == 0 {
+		return errors.Wrap(ErrFieldRequired, "batch_max_wait is required for batch_max_entries and batch_max_bytes, "+
+			"otherwise events of low-volume inputs are held forever")
+	}
+
+	if config.RateLimitEntries < 0 || config.RateLimitBytes < 0 {
+		return errors.Wrap(ErrInvalidValue, "rate_limit_entries and rate_limit_bytes must not be negative")
+	}
+	if config.RateLimitAdaptive && config.RateLimitEntries == 0 && config.RateLimitBytes == 0 {
+		return errors.Wrap(ErrOneOfFieldsRequired, "rate_limit_entries or rate_limit_bytes is required for rate_limit_adaptive")
+	}
+
+	if config.Async {
+		if config.AsyncQueueSize <= 0 {
+			return errors.Wrap(ErrInvalidValue, "async_queue_size must be positive")
+		}
+		if config.AsyncWorkers <= 0 {
+			return errors.Wrap(ErrInvalidValue, "async_workers must be positive")
+		}
+		switch config.AsyncBackpressure {
+		case "", AsyncBackpressureBlock, AsyncBackpressureDropOldest, AsyncBackpressureDropNewest, AsyncBackpressureRetry:
+		default:
+			return errors.Wrapf(ErrInvalidValue, "async_backpressure must be one of `%s`, `%s`, `%s`, `%s`",
+				AsyncBackpressureBlock, AsyncBackpressureDropOldest, AsyncBackpressureDropNewest, AsyncBackpressureRetry)
+		}
+	}
+
+	return nil
+}
+
+// requestTimeout returns request_timeout or the default if it is not set
+func (config OutputPluginConfig) requestTimeout() time.Duration {
+	if config.RequestTimeout <= 0 {
+		return defaultRequestTimeout
+	}
+	return config.RequestTimeout
+}
+
+// tokenLifetime returns token_lifetime or the default if it is not set
+func (config OutputPluginConfig) tokenLifetime() time.Duration {
+	if config.TokenLifetime <= 0 {
+		return defaultTokenLifetime
 	}
+	return config.TokenLifetime
+}
 
-	if config.ResourceType == "" {
-		return errors.Wrap(ErrFieldRequired, "resource_type")
+// validateServiceAccountKey checks that the key is given either by authorized_key_file or by
+// key_id, service_account_id and private_key_file_path options
+func (config OutputPluginConfig) validateServiceAccountKey() error {
+	if config.AuthorizedKeyFilePath != "" {
+		if config.PrivateKeyFilePath != "" {
+			return errors.Wrap(ErrMutuallyExclusiveFields,
+				"authorized_key_file already contains the private key, private_key_file_path must not be set")
+		}
+		if config.KeyID != "" || config.ServiceAccountID != "" {
+			return errors.Wrap(ErrMutuallyExclusiveFields,
+				"authorized_key_file already contains the key id and the service account id, key_id and service_account_id must not be set")
+		}
+		return nil
 	}
 
 	if config.KeyID == "" {
-		return errors.Wrap(ErrFieldRequired, "key_id")
+		return errors.Wrap(ErrFieldRequired, "key_id (or authorized_key_file)")
 	}
 
 	if config.ServiceAccountID == "" {
-		return errors.Wrap(ErrFieldRequired, "service_account_id")
+		return errors.Wrap(ErrFieldRequired, "service_account_id (or authorized_key_file)")
 	}
 
 	if config.PrivateKeyFilePath == "" {
-		return errors.Wrap(ErrFieldRequired, "private_key_file_path")
+		return errors.Wrap(ErrFieldRequired, "private_key_file_path (or authorized_key_file)")
 	}
-
 	return nil
 }
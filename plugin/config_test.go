@@ -2,87 +2,81 @@ package plugin
 
 import (
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_Config_Validate(t *testing.T) {
-	errorsSeq := []error{ErrOneOfFieldsRequired, ErrFieldRequired, ErrFieldRequired,
+	errorsSeq := []error{ErrOneOfFieldsRequired, ErrOneOfFieldsRequired, ErrOneOfFieldsRequired,
 		ErrFieldRequired, ErrFieldRequired, ErrFieldRequired,
 	}
 	logLevelKey := "log_level"
 	configs := []OutputPluginConfig{
 		{
-			0,
-			"",
-			"", // <-- testing this and
-			"",   // <-- this fields
-			"test_resource_id",
-			"test_resource_type",
-			"test_key_id",
-			"test_service_account",
-			"test_private_ket_path",
-			logLevelKey,
+			LogGroupId:         "", // <-- testing this and
+			FolderId:           "", // <-- this fields
+			ResourceId:         "test_resource_id",
+			ResourceType:       "test_resource_type",
+			KeyID:              "test_key_id",
+			ServiceAccountID:   "test_service_account",
+			PrivateKeyFilePath: "test_private_ket_path",
+			LogLevelKey:        logLevelKey,
 		},
 		{
-			0,
-			"",
-			"test_log_group",
-			"test_resource_type",
-			"", // <-- testing this field
-			"test_resource_type",
-			"test_key_id",
-			"test_service_account",
-			"test_private_ket_path",
-			logLevelKey,
+			LogGroupId:         "test_log_group",
+			FolderId:           "test_resource_type",
+			ResourceId:         "", // <-- testing this field
+			ResourceType:       "test_resource_type",
+			KeyID:              "test_key_id",
+			ServiceAccountID:   "test_service_account",
+			PrivateKeyFilePath: "test_private_ket_path",
+			LogLevelKey:        logLevelKey,
 		},
 		{
-			0,
-			"",
-			"test_log_group_id",
-			"test_folder_id",
-			"test_resource_id",
-			"", // <-- testing this field
-			"test_key_id",
-			"test_service_account",
-			"test_private_ket_path",
-			logLevelKey,
+			LogGroupId:         "test_log_group_id",
+			FolderId:           "test_folder_id",
+			ResourceId:         "test_resource_id",
+			ResourceType:       "", // <-- testing this field
+			KeyID:              "test_key_id",
+			ServiceAccountID:   "test_service_account",
+			PrivateKeyFilePath: "test_private_ket_path",
+			LogLevelKey:        logLevelKey,
 		},
 		{
-			0,
-			"",
-			"test_log_group_id",
-			"test_folder_id",
-			"test_resource_id",
-			"test_resource_type",
-			"", // <-- testing this field
-			"test_service_account",
-			"test_private_ket_path",
-			logLevelKey,
+			LogGroupId:         "test_log_group_id",
+			FolderId:           "test_folder_id",
+			ResourceId:         "test_resource_id",
+			ResourceType:       "test_resource_type",
+			KeyID:              "", // <-- testing this field
+			ServiceAccountID:   "test_service_account",
+			PrivateKeyFilePath: "test_private_ket_path",
+			LogLevelKey:        logLevelKey,
 		},
 		{
-			0,
-			"",
-			"test_log_group_id",
-			"test_folder_id",
-			"test_resource_id",
-			"test_resource_type",
-			"test_key_id",
-			"", // <-- testing this field
-			"test_private_ket_path",
-			logLevelKey,
+			LogGroupId:         "test_log_group_id",
+			FolderId:           "test_folder_id",
+			ResourceId:         "test_resource_id",
+			ResourceType:       "test_resource_type",
+			KeyID:              "test_key_id",
+			ServiceAccountID:   "", // <-- testing this field
+			PrivateKeyFilePath: "test_private_ket_path",
+			LogLevelKey:        logLevelKey,
 		},
 		{
-			0,
-			"",
-			"test_log_group_id",
-			"test_folder_id",
-			"test_resource_id",
-			"test_resource_type",
-			"test_key_id",
-			"test_service_account",
-			"", // <-- testing this field
-			logLevelKey,
+			LogGroupId:         "test_log_group_id",
+			FolderId:           "test_folder_id",
+			ResourceId:         "test_resource_id",
+			ResourceType:       "test_resource_type",
+			KeyID:              "test_key_id",
+			ServiceAccountID:   "test_service_account",
+			PrivateKeyFilePath: "", // <-- testing this field
+			LogLevelKey:        logLevelKey,
 		},
 	}
 
@@ -91,3 +85,483 @@ func Test_Config_Validate(t *testing.T) {
 		assert.True(t, errors.Is(err, errorsSeq[idx]), "should have error here")
 	}
 }
+
+func Test_Config_Parse(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		config, err := newOutputPluginConfig(func(key string) string { return "" }, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, config.PluginInstanceId)
+		assert.Equal(t, "level", config.LogLevelKey)
+		assert.Equal(t, []string{"message"}, config.MessageKeys)
+		assert.False(t, config.MessageKeepFields)
+		assert.Equal(t, defaultMaxRequestEntries, config.MaxRequestEntries)
+		assert.Equal(t, defaultMaxRequestBytes, config.MaxRequestBytes)
+		assert.Equal(t, defaultRetryMaxAttempts, config.RetryMaxAttempts)
+		assert.Equal(t, defaultRetryBaseDelay, config.RetryBaseDelay)
+		assert.Equal(t, defaultRetryMaxDelay, config.RetryMaxDelay)
+		assert.Equal(t, defaultRetryJitter, config.RetryJitter)
+		assert.Equal(t, defaultShutdownTimeout, config.ShutdownTimeout)
+		assert.Equal(t, AuthModeServiceAccountKey, config.AuthMode)
+		assert.Equal(t, "", config.SpoolDir)
+		assert.Equal(t, defaultSpoolMaxBytes, config.SpoolMaxBytes)
+		assert.Equal(t, defaultSpoolSegmentBytes, config.SpoolSegmentBytes)
+		assert.Equal(t, SpoolFsyncAlways, config.SpoolFsync)
+		assert.Equal(t, defaultSpoolReplayInterval, config.SpoolReplayInterval)
+		assert.Equal(t, "", config.DeadLetterPath)
+		assert.Equal(t, defaultDeadLetterMaxBytes, config.DeadLetterMaxBytes)
+		assert.Equal(t, defaultDeadLetterMaxFiles, config.DeadLetterMaxFiles)
+		assert.Equal(t, RejectedFallbackLog, config.RejectedEntriesFallback)
+		assert.False(t, config.Async)
+		assert.Equal(t, defaultAsyncQueueSize, config.AsyncQueueSize)
+		assert.Equal(t, defaultAsyncWorkers, config.AsyncWorkers)
+		assert.Equal(t, AsyncBackpressureBlock, config.AsyncBackpressure)
+		assert.Equal(t, 0, config.BatchMaxEntries)
+		assert.Equal(t, 0, config.BatchMaxBytes)
+		assert.Equal(t, time.Duration(0), config.BatchMaxWait)
+		assert.Equal(t, defaultRequestTimeout, config.RequestTimeout)
+		assert.Equal(t, time.Duration(0), config.ConnectTimeout)
+		assert.Equal(t, defaultTokenLifetime, config.TokenLifetime)
+	})
+
+	t.Run("timeout_options", func(t *testing.T) {
+		options := map[string]string{
+			"request_timeout": "30s",
+			"connect_timeout": "2s",
+			"token_lifetime":  "1h",
+		}
+		config, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		require.NoError(t, err)
+		assert.Equal(t, time.Second*30, config.RequestTimeout)
+		assert.Equal(t, time.Second*2, config.ConnectTimeout)
+		assert.Equal(t, time.Hour, config.TokenLifetime)
+	})
+
+	t.Run("token_lifetime_transport", func(t *testing.T) {
+		hook := logtest.NewGlobal()
+		defer hook.Reset()
+		hasWarning := func() bool {
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == log.WarnLevel && strings.Contains(entry.Message, "token_lifetime") {
+					return true
+				}
+			}
+			return false
+		}
+
+		options := map[string]string{"token_lifetime": "1h"}
+		_, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		require.NoError(t, err)
+		assert.True(t, hasWarning(), "token_lifetime should be reported as ignored by grpc transport")
+
+		hook.Reset()
+		options["transport"] = TransportHTTP
+		_, err = newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		require.NoError(t, err)
+		assert.False(t, hasWarning())
+	})
+
+	t.Run("invalid_timeout_options", func(t *testing.T) {
+		invalidOptions := []map[string]string{
+			{"request_timeout": "5"},
+			{"request_timeout": "-1s"},
+			{"connect_timeout": "two seconds"},
+			{"token_lifetime": "0s"},
+		}
+		for _, options := range invalidOptions {
+			_, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+			assert.True(t, errors.Is(err, ErrInvalidValue), "should fail on %v", options)
+		}
+	})
+
+	t.Run("rate_limit_options", func(t *testing.T) {
+		options := map[string]string{
+			"rate_limit_entries":  "1000",
+			"rate_limit_bytes":    "1048576",
+			"rate_limit_adaptive": "on",
+		}
+		config, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		require.NoError(t, err)
+		assert.Equal(t, 1000, config.RateLimitEntries)
+		assert.Equal(t, 1024*1024, config.RateLimitBytes)
+		assert.True(t, config.RateLimitAdaptive)
+	})
+
+	t.Run("dead_letter_path", func(t *testing.T) {
+		options := map[string]string{"dead_letter_path": "/var/log/fluent-bit/dead_letter.log"}
+		config, err := newOutputPluginConfig(func(key string) string { return options[key] }, 1)
+		require.NoError(t, err)
+		assert.Equal(t, "/var/log/fluent-bit/dead_letter.log", config.DeadLetterPath)
+		assert.Equal(t, RejectedFallbackDeadLetter, config.RejectedEntriesFallback, "dead letter file should be the default fallback")
+	})
+
+	t.Run("retry_options", func(t *testing.T) {
+		options := map[string]string{
+			"retry_max_attempts": "5",
+			"retry_base_delay":   "50ms",
+			"retry_max_delay":    "10s",
+			"retry_jitter":       "0.5",
+		}
+		config, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		require.NoError(t, err)
+		assert.Equal(t, 5, config.RetryMaxAttempts)
+		assert.Equal(t, time.Millisecond*50, config.RetryBaseDelay)
+		assert.Equal(t, time.Second*10, config.RetryMaxDelay)
+		assert.Equal(t, 0.5, config.RetryJitter)
+	})
+
+	t.Run("message_options", func(t *testing.T) {
+		options := map[string]string{
+			"message_key":         "msg, log ,short_message",
+			"message_template":    "{{.method}} {{.path}}",
+			"message_keep_fields": "On",
+		}
+		config, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"msg", "log", "short_message"}, config.MessageKeys)
+		assert.Equal(t, "{{.method}} {{.path}}", config.MessageTemplate)
+		assert.True(t, config.MessageKeepFields)
+	})
+
+	t.Run("invalid_message_options", func(t *testing.T) {
+		invalidOptions := []map[string]string{
+			{"message_template": "{{.method"},
+			{"message_keep_fields": "maybe"},
+		}
+		for _, options := range invalidOptions {
+			_, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+			assert.True(t, errors.Is(err, ErrInvalidValue), "should fail on %v", options)
+		}
+	})
+
+	t.Run("invalid_retry_options", func(t *testing.T) {
+		invalidOptions := []map[string]string{
+			{"retry_base_delay": "fast"},
+			{"retry_max_delay": "-1s"},
+			{"retry_jitter": "1.5"},
+			{"retry_jitter": "some"},
+		}
+		for _, options := range invalidOptions {
+			_, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+			assert.True(t, errors.Is(err, ErrInvalidValue), "should fail on %v", options)
+		}
+	})
+
+	t.Run("request_limits", func(t *testing.T) {
+		options := map[string]string{"max_request_entries": "10", "max_request_bytes": "2048"}
+		config, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		require.NoError(t, err)
+		assert.Equal(t, 10, config.MaxRequestEntries)
+		assert.Equal(t, 2048, config.MaxRequestBytes)
+	})
+
+	t.Run("routing_options", func(t *testing.T) {
+		options := map[string]string{
+			"log_group_id_key":  "$kubernetes['namespace_name']",
+			"folder_id_key":     "folder",
+			"tag_log_group_map": `kube\..*:kube_group`,
+		}
+		config, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"kubernetes", "namespace_name"}, config.LogGroupIdKey.path)
+		assert.Equal(t, []string{"folder"}, config.FolderIdKey.path)
+		require.Len(t, config.TagLogGroupMap, 1)
+		assert.Equal(t, "kube_group", config.TagLogGroupMap[0].logGroupId)
+	})
+
+	t.Run("stream_name_options", func(t *testing.T) {
+		options := map[string]string{"stream_name": "default", "stream_name_key": "$TAG"}
+		config, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		require.NoError(t, err)
+		assert.Equal(t, "default", config.StreamName)
+		assert.True(t, config.StreamNameFromTag)
+
+		options["stream_name_key"] = "$kubernetes['container_name']"
+		config, err = newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		require.NoError(t, err)
+		assert.False(t, config.StreamNameFromTag)
+		assert.Equal(t, []string{"kubernetes", "container_name"}, config.StreamNameKey.path)
+	})
+
+	t.Run("default_options", func(t *testing.T) {
+		options := map[string]string{
+			"default_level":   "warning",
+			"default_payload": `{"cluster": "prod", "region": {"zone": "ru-central1-a"}}`,
+		}
+		config, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		require.NoError(t, err)
+		assert.Equal(t, logging.LogLevel_WARN, config.DefaultLevel)
+		assert.Equal(t, "prod", config.DefaultPayload.Fields["cluster"].GetStringValue())
+		assert.Equal(t, "ru-central1-a", config.DefaultPayload.Fields["region"].GetStructValue().Fields["zone"].GetStringValue())
+	})
+
+	t.Run("invalid_default_options", func(t *testing.T) {
+		invalidOptions := []map[string]string{
+			{"default_level": "verbose"},
+			{"default_payload": `["cluster"]`},
+			{"default_payload": `{"cluster": `},
+		}
+		for _, options := range invalidOptions {
+			_, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+			assert.True(t, errors.Is(err, ErrInvalidValue), "should fail on %v", options)
+		}
+	})
+
+	t.Run("payload_options", func(t *testing.T) {
+		options := map[string]string{
+			"payload_key":  "log",
+			"include_keys": "method, http.status",
+			"exclude_keys": "$http['body']",
+		}
+		config, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"log"}, config.PayloadKey.path)
+		require.Len(t, config.IncludeKeys, 2)
+		assert.Equal(t, []string{"http", "status"}, config.IncludeKeys[1].path)
+		require.Len(t, config.ExcludeKeys, 1)
+		assert.Equal(t, []string{"http", "body"}, config.ExcludeKeys[0].path)
+
+		options["exclude_keys"] = "http..body"
+		_, err = newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+		assert.True(t, errors.Is(err, ErrInvalidValue))
+	})
+
+	t.Run("invalid_request_limits", func(t *testing.T) {
+		for _, value := range []string{"abc", "0", "-5"} {
+			options := map[string]string{"max_request_entries": value}
+			_, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+			assert.True(t, errors.Is(err, ErrInvalidValue), "should fail on `%s`", value)
+		}
+	})
+}
+
+func Test_Config_Validate_PartialFailureOptions(t *testing.T) {
+	config := OutputPluginConfig{
+		LogGroupId:         "test_log_group_id",
+		ResourceId:         "test_resource_id",
+		ResourceType:       "test_resource_type",
+		KeyID:              "test_key_id",
+		ServiceAccountID:   "test_service_account",
+		PrivateKeyFilePath: "test_private_ket_path",
+	}
+	assert.NoError(t, config.Validate())
+
+	invalidPolicy := config
+	invalidPolicy.PartialFailurePolicy = "sometimes"
+	assert.True(t, errors.Is(invalidPolicy.Validate(), ErrInvalidValue))
+
+	invalidFallback := config
+	invalidFallback.RejectedEntriesFallback = "somewhere"
+	assert.True(t, errors.Is(invalidFallback.Validate(), ErrInvalidValue))
+
+	deadLetterFallback := config
+	deadLetterFallback.RejectedEntriesFallback = RejectedFallbackDeadLetter
+	assert.True(t, errors.Is(deadLetterFallback.Validate(), ErrFieldRequired))
+	deadLetterFallback.DeadLetterPath = "/var/log/fluent-bit/dead_letter.log"
+	deadLetterFallback.DeadLetterMaxBytes = defaultDeadLetterMaxBytes
+	assert.NoError(t, deadLetterFallback.Validate())
+	deadLetterFallback.DeadLetterMaxBytes = 0
+	assert.True(t, errors.Is(deadLetterFallback.Validate(), ErrInvalidValue))
+}
+
+func Test_Config_Validate_SpoolOptions(t *testing.T) {
+	config := OutputPluginConfig{
+		LogGroupId:         "test_log_group_id",
+		ResourceId:         "test_resource_id",
+		ResourceType:       "test_resource_type",
+		KeyID:              "test_key_id",
+		ServiceAccountID:   "test_service_account",
+		PrivateKeyFilePath: "test_private_ket_path",
+		SpoolDir:           "/var/lib/fluent-bit/spool",
+		SpoolMaxBytes:      defaultSpoolMaxBytes,
+		SpoolSegmentBytes:  defaultSpoolSegmentBytes,
+		SpoolFsync:         SpoolFsyncSegment,
+	}
+	assert.NoError(t, config.Validate())
+
+	invalidFsync := config
+	invalidFsync.SpoolFsync = "sometimes"
+	assert.True(t, errors.Is(invalidFsync.Validate(), ErrInvalidValue))
+
+	largeSegment := config
+	largeSegment.SpoolSegmentBytes = config.SpoolMaxBytes + 1
+	assert.True(t, errors.Is(largeSegment.Validate(), ErrInvalidValue))
+}
+
+func Test_Config_Validate_TokenLifetime(t *testing.T) {
+	config := OutputPluginConfig{
+		LogGroupId:         "test_log_group_id",
+		ResourceId:         "test_resource_id",
+		ResourceType:       "test_resource_type",
+		KeyID:              "test_key_id",
+		ServiceAccountID:   "test_service_account",
+		PrivateKeyFilePath: "test_private_ket_path",
+		TokenLifetime:      maxTokenLifetime,
+	}
+	assert.NoError(t, config.Validate())
+
+	config.TokenLifetime = maxTokenLifetime + time.Minute
+	assert.True(t, errors.Is(config.Validate(), ErrInvalidValue))
+}
+
+func Test_Config_Validate_BatchOptions(t *testing.T) {
+	config := OutputPluginConfig{
+		LogGroupId:         "test_log_group_id",
+		ResourceId:         "test_resource_id",
+		ResourceType:       "test_resource_type",
+		KeyID:              "test_key_id",
+		ServiceAccountID:   "test_service_account",
+		PrivateKeyFilePath: "test_private_ket_path",
+		BatchMaxEntries:    1000,
+		BatchMaxBytes:      1024 * 1024,
+		BatchMaxWait:       time.Second,
+	}
+	assert.NoError(t, config.Validate())
+
+	noWait := config
+	noWait.BatchMaxWait = 0
+	assert.True(t, errors.Is(noWait.Validate(), ErrFieldRequired))
+
+	negativeEntries := config
+	negativeEntries.BatchMaxEntries = -1
+	assert.True(t, errors.Is(negativeEntries.Validate(), ErrInvalidValue))
+}
+
+func Test_Config_Validate_RateLimitOptions(t *testing.T) {
+	config := OutputPluginConfig{
+		LogGroupId:         "test_log_group_id",
+		ResourceId:         "test_resource_id",
+		ResourceType:       "test_resource_type",
+		KeyID:              "test_key_id",
+		ServiceAccountID:   "test_service_account",
+		PrivateKeyFilePath: "test_private_ket_path",
+		RateLimitBytes:     1024 * 1024,
+		RateLimitAdaptive:  true,
+	}
+	assert.NoError(t, config.Validate())
+
+	noLimit := config
+	noLimit.RateLimitBytes = 0
+	assert.True(t, errors.Is(noLimit.Validate(), ErrOneOfFieldsRequired))
+
+	negativeEntries := config
+	negativeEntries.RateLimitEntries = -1
+	assert.True(t, errors.Is(negativeEntries.Validate(), ErrInvalidValue))
+}
+
+func Test_Config_Validate_AsyncOptions(t *testing.T) {
+	config := OutputPluginConfig{
+		LogGroupId:         "test_log_group_id",
+		ResourceId:         "test_resource_id",
+		ResourceType:       "test_resource_type",
+		KeyID:              "test_key_id",
+		ServiceAccountID:   "test_service_account",
+		PrivateKeyFilePath: "test_private_ket_path",
+		Async:              true,
+		AsyncQueueSize:     defaultAsyncQueueSize,
+		AsyncWorkers:       defaultAsyncWorkers,
+		AsyncBackpressure:  AsyncBackpressureDropOldest,
+	}
+	assert.NoError(t, config.Validate())
+
+	invalidBackpressure := config
+	invalidBackpressure.AsyncBackpressure = "sometimes"
+	assert.True(t, errors.Is(invalidBackpressure.Validate(), ErrInvalidValue))
+
+	noWorkers := config
+	noWorkers.AsyncWorkers = 0
+	assert.True(t, errors.Is(noWorkers.Validate(), ErrInvalidValue))
+
+	noQueue := config
+	noQueue.AsyncQueueSize = 0
+	assert.True(t, errors.Is(noQueue.Validate(), ErrInvalidValue))
+}
+
+func Test_Config_Validate_MetricsListen(t *testing.T) {
+	config := OutputPluginConfig{
+		LogGroupId:         "test_log_group_id",
+		ResourceId:         "test_resource_id",
+		ResourceType:       "test_resource_type",
+		KeyID:              "test_key_id",
+		ServiceAccountID:   "test_service_account",
+		PrivateKeyFilePath: "test_private_ket_path",
+	}
+	for _, listen := range []string{"", ":2021", "127.0.0.1:2021"} {
+		config.MetricsListen = listen
+		assert.NoError(t, config.Validate(), listen)
+	}
+	config.MetricsListen = "2021"
+	assert.True(t, errors.Is(config.Validate(), ErrInvalidValue))
+}
+
+func Test_Config_Validate_AuthorizedKeyFile(t *testing.T) {
+	config := OutputPluginConfig{
+		LogGroupId:            "test_log_group_id",
+		ResourceId:            "test_resource_id",
+		ResourceType:          "test_resource_type",
+		AuthorizedKeyFilePath: "test_authorized_key_path",
+	}
+	assert.NoError(t, config.Validate(), "key_id and service_account_id are optional with authorized_key_file")
+
+	withPrivateKey := config
+	withPrivateKey.PrivateKeyFilePath = "test_private_ket_path"
+	assert.True(t, errors.Is(withPrivateKey.Validate(), ErrMutuallyExclusiveFields))
+
+	withKeyID := config
+	withKeyID.KeyID = "test_key_id"
+	assert.True(t, errors.Is(withKeyID.Validate(), ErrMutuallyExclusiveFields), "key_id must not override authorized_key_file")
+
+	withServiceAccountID := config
+	withServiceAccountID.ServiceAccountID = "test_service_account_id"
+	assert.True(t, errors.Is(withServiceAccountID.Validate(), ErrMutuallyExclusiveFields),
+		"service_account_id must not override authorized_key_file")
+
+	withoutKey := config
+	withoutKey.AuthorizedKeyFilePath = ""
+	assert.True(t, errors.Is(withoutKey.Validate(), ErrFieldRequired))
+}
+
+func Test_Config_AuthMode(t *testing.T) {
+	config := OutputPluginConfig{
+		LogGroupId:   "test_log_group_id",
+		ResourceId:   "test_resource_id",
+		ResourceType: "test_resource_type",
+		AuthMode:     AuthModeMetadata,
+	}
+	assert.NoError(t, config.Validate(), "metadata auth doesn't need a key")
+
+	withoutToken := config
+	withoutToken.AuthMode = AuthModeIAMToken
+	assert.True(t, errors.Is(withoutToken.Validate(), ErrFieldRequired))
+
+	withoutTokenFile := config
+	withoutTokenFile.AuthMode = AuthModeIAMTokenFile
+	assert.True(t, errors.Is(withoutTokenFile.Validate(), ErrFieldRequired))
+
+	unknownMode := config
+	unknownMode.AuthMode = "password"
+	assert.True(t, errors.Is(unknownMode.Validate(), ErrInvalidValue))
+
+	t.Setenv(iamTokenEnv, "test_env_token")
+	options := map[string]string{"auth_mode": "IAM_TOKEN"}
+	parsed, err := newOutputPluginConfig(func(key string) string { return options[key] }, 0)
+	require.NoError(t, err)
+	assert.Equal(t, AuthModeIAMToken, parsed.AuthMode)
+	assert.Equal(t, "test_env_token", parsed.IAMToken)
+}
+
+func Test_Config_Validate_ResourceKeys(t *testing.T) {
+	config := OutputPluginConfig{
+		LogGroupId: "test_log_group_id",
+		AuthMode:   AuthModeMetadata,
+	}
+	config.ResourceIdKey, _ = parseRecordAccessor("kubernetes.pod_name")
+	config.ResourceTypeKey, _ = parseRecordAccessor("resource_type")
+	assert.NoError(t, config.Validate(), "static resource is not required with resource keys")
+
+	withoutTypeKey := config
+	withoutTypeKey.ResourceTypeKey = recordAccessor{}
+	assert.True(t, errors.Is(withoutTypeKey.Validate(), ErrOneOfFieldsRequired))
+
+	withoutTypeKey.ResourceType = "k8s.pod"
+	assert.NoError(t, withoutTypeKey.Validate())
+}
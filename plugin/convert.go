@@ -0,0 +1,148 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"fmt"
+	fluentbit "github.com/fluent/fluent-bit-go/output"
+	"google.golang.org/protobuf/types/known/structpb"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxSafeInteger is the largest integer which float64 holds without precision loss
+const maxSafeInteger = 1 << 53
+
+// toStruct converts a record decoded from msgpack into structpb.Struct
+func toStruct(record map[interface{}]interface{}) (*structpb.Struct, error) {
+	fields := make(map[string]*structpb.Value, len(record))
+	for k, v := range record {
+		key := toStructKey(k)
+		value, err := toStructValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("field `%s`: %v", key, err)
+		}
+		fields[key] = value
+	}
+	return &structpb.Struct{Fields: fields}, nil
+}
+
+// toStructValue converts a value decoded from msgpack into structpb.Value.
+// Byte strings become strings if they are valid UTF-8 and base64 encoded strings otherwise.
+// Integers which do not fit float64 without precision loss are converted into decimal strings,
+// NaN and infinities, which JSON can't hold, into "NaN", "Infinity" and "-Infinity".
+func toStructValue(v interface{}) (*structpb.Value, error) {
+	switch t := v.(type) {
+	case nil:
+		return structpb.NewNullValue(), nil
+	case bool:
+		return structpb.NewBoolValue(t), nil
+	case string:
+		return structpb.NewStringValue(validUTF8(t)), nil
+	case []byte:
+		if utf8.Valid(t) {
+			return structpb.NewStringValue(string(t)), nil
+		}
+		return structpb.NewStringValue(base64.StdEncoding.EncodeToString(t)), nil
+	case int:
+		return intValue(int64(t)), nil
+	case int8:
+		return intValue(int64(t)), nil
+	case int16:
+		return intValue(int64(t)), nil
+	case int32:
+		return intValue(int64(t)), nil
+	case int64:
+		return intValue(t), nil
+	case uint:
+		return uintValue(uint64(t)), nil
+	case uint8:
+		return uintValue(uint64(t)), nil
+	case uint16:
+		return uintValue(uint64(t)), nil
+	case uint32:
+		return uintValue(uint64(t)), nil
+	case uint64:
+		return uintValue(t), nil
+	case float32:
+		return floatValue(float64(t)), nil
+	case float64:
+		return floatValue(t), nil
+	case time.Time:
+		return structpb.NewStringValue(t.Format(time.RFC3339Nano)), nil
+	case fluentbit.FLBTime:
+		return structpb.NewStringValue(t.Format(time.RFC3339Nano)), nil
+	case map[interface{}]interface{}:
+		s, err := toStruct(t)
+		if err != nil {
+			return nil, err
+		}
+		return structpb.NewStructValue(s), nil
+	case map[string]interface{}:
+		fields := make(map[string]*structpb.Value, len(t))
+		for key, val := range t {
+			value, err := toStructValue(val)
+			if err != nil {
+				return nil, fmt.Errorf("field `%s`: %v", key, err)
+			}
+			fields[key] = value
+		}
+		return structpb.NewStructValue(&structpb.Struct{Fields: fields}), nil
+	case []interface{}:
+		values := make([]*structpb.Value, 0, len(t))
+		for idx, val := range t {
+			value, err := toStructValue(val)
+			if err != nil {
+				return nil, fmt.Errorf("item %d: %v", idx, err)
+			}
+			values = append(values, value)
+		}
+		return structpb.NewListValue(&structpb.ListValue{Values: values}), nil
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+func toStructKey(k interface{}) string {
+	switch t := k.(type) {
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+func intValue(i int64) *structpb.Value {
+	if i > maxSafeInteger || i < -maxSafeInteger {
+		return structpb.NewStringValue(strconv.FormatInt(i, 10))
+	}
+	return structpb.NewNumberValue(float64(i))
+}
+
+func floatValue(f float64) *structpb.Value {
+	switch {
+	case math.IsNaN(f):
+		return structpb.NewStringValue("NaN")
+	case math.IsInf(f, 1):
+		return structpb.NewStringValue("Infinity")
+	case math.IsInf(f, -1):
+		return structpb.NewStringValue("-Infinity")
+	}
+	return structpb.NewNumberValue(f)
+}
+
+// validUTF8 replaces invalid UTF-8 sequences, since protobuf string fields must be valid UTF-8
+func validUTF8(s string) string {
+	return strings.ToValidUTF8(s, string(utf8.RuneError))
+}
+
+func uintValue(u uint64) *structpb.Value {
+	if u > maxSafeInteger {
+		return structpb.NewStringValue(strconv.FormatUint(u, 10))
+	}
+	return structpb.NewNumberValue(float64(u))
+}
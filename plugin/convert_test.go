@@ -0,0 +1,115 @@
+package plugin
+
+import (
+	fluentbit "github.com/fluent/fluent-bit-go/output"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_ToStructValue(t *testing.T) {
+	ts := time.Date(2021, 8, 20, 10, 15, 30, 123456789, time.UTC)
+	cases := []struct {
+		name     string
+		value    interface{}
+		expected *structpb.Value
+	}{
+		{"nil", nil, structpb.NewNullValue()},
+		{"bool", true, structpb.NewBoolValue(true)},
+		{"string", "value", structpb.NewStringValue("value")},
+		{"invalid_utf8_string", "val\xffue", structpb.NewStringValue("val�ue")},
+		{"utf8_bytes", []byte("значение"), structpb.NewStringValue("значение")},
+		{"binary_bytes", []byte{0xff, 0xfe, 0x00}, structpb.NewStringValue("//4A")},
+		{"int64", int64(-42), structpb.NewNumberValue(-42)},
+		{"int8", int8(7), structpb.NewNumberValue(7)},
+		{"uint64", uint64(42), structpb.NewNumberValue(42)},
+		{"max_safe_uint64", uint64(1 << 53), structpb.NewNumberValue(1 << 53)},
+		{"big_uint64", uint64(18446744073709551615), structpb.NewStringValue("18446744073709551615")},
+		{"big_int64", int64(-9007199254740993), structpb.NewStringValue("-9007199254740993")},
+		{"float32", float32(1.5), structpb.NewNumberValue(1.5)},
+		{"float64", 2.25, structpb.NewNumberValue(2.25)},
+		{"nan", math.NaN(), structpb.NewStringValue("NaN")},
+		{"float32_inf", float32(math.Inf(1)), structpb.NewStringValue("Infinity")},
+		{"negative_inf", math.Inf(-1), structpb.NewStringValue("-Infinity")},
+		{"time", ts, structpb.NewStringValue("2021-08-20T10:15:30.123456789Z")},
+		{"flb_time", fluentbit.FLBTime{Time: ts}, structpb.NewStringValue("2021-08-20T10:15:30.123456789Z")},
+		{
+			"slice",
+			[]interface{}{"a", []byte("b"), uint64(1)},
+			structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{
+				structpb.NewStringValue("a"), structpb.NewStringValue("b"), structpb.NewNumberValue(1),
+			}}),
+		},
+		{
+			"nested_map",
+			map[interface{}]interface{}{
+				"kubernetes": map[interface{}]interface{}{
+					"pod_name": []byte("pod-1"),
+					"labels":   map[interface{}]interface{}{"app": "web"},
+				},
+				int64(1): "numeric key",
+			},
+			structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+				"kubernetes": structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+					"pod_name": structpb.NewStringValue("pod-1"),
+					"labels": structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+						"app": structpb.NewStringValue("web"),
+					}}),
+				}}),
+				"1": structpb.NewStringValue("numeric key"),
+			}}),
+		},
+		{
+			"string_map",
+			map[string]interface{}{"key": uint64(5)},
+			structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+				"key": structpb.NewNumberValue(5),
+			}}),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			value, err := toStructValue(c.value)
+			require.NoError(t, err)
+			assert.True(t, proto.Equal(c.expected, value), "expected %v, got %v", c.expected, value)
+		})
+	}
+}
+
+func Test_ToStructValue_Unsupported(t *testing.T) {
+	cases := []struct {
+		name  string
+		value interface{}
+	}{
+		{"channel", make(chan int)},
+		{"nested_channel", map[interface{}]interface{}{"key": []interface{}{make(chan int)}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := toStructValue(c.value)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_ToStruct(t *testing.T) {
+	record := map[interface{}]interface{}{
+		"log":    []byte("message"),
+		"status": uint64(200),
+		"nested": map[interface{}]interface{}{"list": []interface{}{int64(1), nil}},
+	}
+
+	s, err := toStruct(record)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"log":    "message",
+		"status": float64(200),
+		"nested": map[string]interface{}{"list": []interface{}{float64(1), nil}},
+	}, s.AsMap())
+}
@@ -0,0 +1,209 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	"os"
+	"sync"
+	"time"
+	"yandex_logging/plugin/dto"
+)
+
+const (
+	defaultDeadLetterMaxBytes = 100 * 1024 * 1024
+	defaultDeadLetterMaxFiles = 5
+)
+
+// deadLetterRecord is a line of the dead letter file describing an entry which was not delivered
+type deadLetterRecord struct {
+	Time        time.Time                  `json:"time"`
+	Reason      string                     `json:"reason"`
+	Tag         string                     `json:"tag,omitempty"`
+	Destination dto.YCLogRecordDestination `json:"destination"`
+	Resource    dto.YCLogRecordResource    `json:"resource"`
+	Timestamp   time.Time                  `json:"timestamp"`
+	Level       string                     `json:"level,omitempty"`
+	Message     string                     `json:"message,omitempty"`
+	StreamName  string                     `json:"streamName,omitempty"`
+	JsonPayload interface{}                `json:"jsonPayload,omitempty"`
+}
+
+func newDeadLetterRecord(reason string, destination dto.YCLogRecordDestination, resource dto.YCLogRecordResource,
+	entry *dto.YCLogRecordEntry) deadLetterRecord {
+	return deadLetterRecord{
+		Time:        time.Now(),
+		Reason:      reason,
+		Tag:         entry.Tag,
+		Destination: destination,
+		Resource:    resource,
+		Timestamp:   entry.Timestamp,
+		Level:       entry.Level,
+		Message:     entry.Message,
+		StreamName:  entry.StreamName,
+		JsonPayload: deadLetterValue(entry.JsonPayload),
+	}
+}
+
+// newDeadLetterRecords returns records of the entries of the write request, used for spooled requests
+// which have no source entries anymore
+func newDeadLetterRecords(reason string, wr *logging.WriteRequest) []deadLetterRecord {
+	destination := writeRequestDestination(wr)
+	resource := dto.YCLogRecordResource{ID: wr.GetResource().GetId(), Type: wr.GetResource().GetType()}
+	records := make([]deadLetterRecord, 0, len(wr.GetEntries()))
+	for _, entry := range wr.GetEntries() {
+		record := deadLetterRecord{
+			Time:        time.Now(),
+			Reason:      reason,
+			Destination: destination,
+			Resource:    resource,
+			Timestamp:   entry.GetTimestamp().AsTime(),
+			Level:       entry.GetLevel().String(),
+			Message:     entry.GetMessage(),
+			StreamName:  entry.GetStreamName(),
+		}
+		if entry.GetJsonPayload() != nil {
+			record.JsonPayload = entry.GetJsonPayload().AsMap()
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// deadLetterValue converts a value decoded from msgpack into a value encoding/json is able to marshal.
+// Unlike toStructValue it never fails, values of unsupported types are written as strings.
+func deadLetterValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for key, val := range t {
+			m[toStructKey(key)] = deadLetterValue(val)
+		}
+		return m
+	case []interface{}:
+		values := make([]interface{}, 0, len(t))
+		for _, val := range t {
+			values = append(values, deadLetterValue(val))
+		}
+		return values
+	}
+	value, err := toStructValue(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return value.AsInterface()
+}
+
+// deadLetterFile appends undelivered entries to the file as JSON lines. When the file grows over max bytes,
+// it is renamed to `<path>.1`, older files are shifted up to `<path>.<max files>` and the oldest one is removed.
+type deadLetterFile struct {
+	path             string
+	maxBytes         int64
+	maxFiles         int
+	pluginInstanceID int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openDeadLetterFile(config OutputPluginConfig) (*deadLetterFile, error) {
+	f := &deadLetterFile{
+		path:             config.DeadLetterPath,
+		maxBytes:         int64(config.DeadLetterMaxBytes),
+		maxFiles:         config.DeadLetterMaxFiles,
+		pluginInstanceID: config.PluginInstanceId,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *deadLetterFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open dead letter file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "unable to open dead letter file")
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file and starts a new one
+func (f *deadLetterFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	for idx := f.maxFiles - 1; idx > 0; idx-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", f.path, idx), fmt.Sprintf("%s.%d", f.path, idx+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if f.maxFiles > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Write appends the records to the file. Errors are logged, since there is nowhere else to put the records.
+// Write is no-op for nil file, so callers don't check if dead_letter_path is set.
+func (f *deadLetterFile) Write(records []deadLetterRecord) {
+	if f == nil || len(records) == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			log.Errorf("[yandexcloud %d] unable to marshal dead letter record: %v", f.pluginInstanceID, err)
+			continue
+		}
+		line = append(line, '\n')
+
+		if f.file != nil && f.size > 0 && f.size+int64(len(line)) > f.maxBytes {
+			if err := f.rotate(); err != nil {
+				log.Errorf("[yandexcloud %d] unable to rotate dead letter file: %v", f.pluginInstanceID, err)
+			}
+		}
+		if f.file == nil {
+			if err := f.open(); err != nil {
+				log.Errorf("[yandexcloud %d] %d dead letter records are lost: %v", f.pluginInstanceID, len(records), err)
+				return
+			}
+		}
+		n, err := f.file.Write(line)
+		f.size += int64(n)
+		if err != nil {
+			log.Errorf("[yandexcloud %d] unable to write dead letter file: %v", f.pluginInstanceID, err)
+		}
+	}
+}
+
+func (f *deadLetterFile) Close() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"yandex_logging/plugin/dto"
+)
+
+// readDeadLetterFile returns records of the dead letter file
+func readDeadLetterFile(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func Test_DeadLetterFile_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead_letter.log")
+	f, err := openDeadLetterFile(OutputPluginConfig{DeadLetterPath: path, DeadLetterMaxBytes: 1024 * 1024, DeadLetterMaxFiles: 1})
+	require.NoError(t, err)
+
+	entry := &dto.YCLogRecordEntry{
+		Timestamp: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level:     "INFO",
+		Message:   "test_message",
+		Tag:       "test_tag",
+		JsonPayload: map[interface{}]interface{}{
+			"key1":   []byte("value1"),
+			"nested": map[interface{}]interface{}{"key2": int64(2)},
+			"items":  []interface{}{"item", struct{ A int }{A: 1}},
+		},
+	}
+	destination := dto.YCLogRecordDestination{LogGroupID: "test_log_group_id"}
+	resource := dto.YCLogRecordResource{ID: "test_resource_id", Type: "test_resource_type"}
+	f.Write([]deadLetterRecord{newDeadLetterRecord("test_reason", destination, resource, entry)})
+	require.NoError(t, f.Close())
+
+	records := readDeadLetterFile(t, path)
+	require.Equal(t, 1, len(records))
+	record := records[0]
+	assert.Equal(t, "test_reason", record["reason"])
+	assert.Equal(t, "test_tag", record["tag"])
+	assert.Equal(t, "2021-01-02T03:04:05Z", record["timestamp"])
+	assert.Equal(t, map[string]interface{}{"logGroupId": "test_log_group_id", "folderId": ""}, record["destination"])
+	assert.Equal(t, map[string]interface{}{"id": "test_resource_id", "type": "test_resource_type"}, record["resource"])
+	assert.Equal(t, "test_message", record["message"])
+	assert.Equal(t, map[string]interface{}{
+		"key1":   "value1",
+		"nested": map[string]interface{}{"key2": float64(2)},
+		"items":  []interface{}{"item", "{1}"},
+	}, record["jsonPayload"])
+}
+
+func Test_DeadLetterFile_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead_letter.log")
+	config := OutputPluginConfig{DeadLetterPath: path, DeadLetterMaxBytes: 300, DeadLetterMaxFiles: 2}
+	f, err := openDeadLetterFile(config)
+	require.NoError(t, err)
+	defer f.Close()
+
+	entry := &dto.YCLogRecordEntry{Timestamp: time.Now(), Message: "test_message"}
+	for _, reason := range []string{"reason_1", "reason_2", "reason_3", "reason_4"} {
+		record := newDeadLetterRecord(reason, dto.YCLogRecordDestination{}, dto.YCLogRecordResource{}, entry)
+		f.Write([]deadLetterRecord{record})
+	}
+
+	reasons := func(path string) []interface{} {
+		var reasons []interface{}
+		for _, record := range readDeadLetterFile(t, path) {
+			reasons = append(reasons, record["reason"])
+		}
+		return reasons
+	}
+	assert.Equal(t, []interface{}{"reason_4"}, reasons(path))
+	assert.Equal(t, []interface{}{"reason_3"}, reasons(path+".1"))
+	assert.Equal(t, []interface{}{"reason_2"}, reasons(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "files over dead_letter_max_files should be removed")
+}
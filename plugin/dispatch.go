@@ -0,0 +1,508 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+	"yandex_logging/plugin/dto"
+)
+
+// writeRequestFn sends a single write request using the transport of the sender
+type writeRequestFn func(ctx context.Context, wr *logging.WriteRequest) (*logging.WriteResponse, error)
+
+// requestDispatcher sends the request model to Yandex Cloud Logging. It converts entries into write request
+// entries, splits them into batches within request limits, retries failed batches and handles rejected entries.
+type requestDispatcher struct {
+	config           OutputPluginConfig
+	parentCtx        context.Context
+	requestTimeout   time.Duration
+	retryPolicy      retryPolicy
+	rejectedFallback rejectedEntriesFallback
+	write            writeRequestFn
+	// defaults are merged into entries by the server
+	defaults *logging.LogEntryDefaults
+	// entrySize returns the size an entry takes in the request
+	entrySize func(entry *logging.IncomingLogEntry) int
+	// headerSize returns the size of the request without entries
+	headerSize func(wr *logging.WriteRequest) int
+	// spool keeps batches failed because of transient errors until they are replayed
+	spool      *diskSpool
+	replayDone chan struct{}
+	// deadLetter receives entries which are dropped, nil if dead_letter_path is not set
+	deadLetter *deadLetterFile
+	// limiter limits the rate of write requests, nil if rate_limit_entries and rate_limit_bytes are not set
+	limiter *rateLimiter
+	metrics pluginMetrics
+}
+
+func newRequestDispatcher(ctx context.Context, config OutputPluginConfig, requestTimeout time.Duration, write writeRequestFn) requestDispatcher {
+	return requestDispatcher{
+		config:           config,
+		parentCtx:        ctx,
+		requestTimeout:   requestTimeout,
+		retryPolicy:      newRetryPolicy(config),
+		rejectedFallback: newRejectedEntriesFallback(config, nil),
+		write:            write,
+		defaults:         newLogEntryDefaults(config),
+		entrySize:        protoEntrySize,
+		headerSize:       protoHeaderSize,
+		limiter:          newRateLimiter(config),
+		metrics:          newPluginMetrics(config.PluginInstanceId),
+	}
+}
+
+// newLogEntryDefaults returns defaults of the write request set by default_level and default_payload options
+func newLogEntryDefaults(config OutputPluginConfig) *logging.LogEntryDefaults {
+	if config.DefaultLevel == logging.LogLevel_LEVEL_UNSPECIFIED && config.DefaultPayload == nil {
+		return nil
+	}
+	return &logging.LogEntryDefaults{
+		Level:       config.DefaultLevel,
+		JsonPayload: config.DefaultPayload,
+	}
+}
+
+// protoEntrySize returns the size of the entry serialized into the write request
+func protoEntrySize(entry *logging.IncomingLogEntry) int {
+	return protowire.SizeTag(3) + protowire.SizeBytes(proto.Size(entry))
+}
+
+func protoHeaderSize(wr *logging.WriteRequest) int {
+	return proto.Size(wr)
+}
+
+// sendRequestModels sends request models of different destinations and resources one by one. The chunk is retried as a whole,
+// so the error is permanent only if all failed requests are not worth retrying.
+func (d requestDispatcher) sendRequestModels(models []*dto.YCLogRecordRequestModel, handler requestHandler) error {
+	config := d.config
+	var lastErr error
+	failedModels, permanentFailures := 0, 0
+	for _, reqModel := range models {
+		err := reqModel.Validate()
+		if err != nil {
+			d.metrics.entriesDropped(reqModel.Destination, dropReasonInvalidRequest, len(reqModel.Entries))
+			d.deadLetterEntries(fmt.Sprintf("validation failed: %v", err), reqModel, reqModel.Entries)
+			entriesDone(reqModel.Entries)
+			err = permanentError{err: err}
+		} else {
+			err = handler(reqModel)
+		}
+		if err == nil {
+			continue
+		}
+		if len(models) > 1 {
+			log.Errorf("[yandexcloud %d] request to %s of resource %s/%s failed: %v", config.PluginInstanceId,
+				destinationName(reqModel.Destination), reqModel.Resource.Type, reqModel.Resource.ID, err)
+		}
+		failedModels++
+		if errors.Is(err, ErrPermanent) {
+			permanentFailures++
+		}
+		lastErr = err
+	}
+
+	if failedModels == 0 {
+		return nil
+	}
+	if len(models) == 1 {
+		return lastErr
+	}
+	err := errors.Wrapf(lastErr, "%d of %d requests failed", failedModels, len(models))
+	if permanentFailures == failedModels {
+		return permanentError{err: err}
+	}
+	return err
+}
+
+// destinationName returns human readable destination for logs
+func destinationName(destination dto.YCLogRecordDestination) string {
+	if destination.FolderId != "" && destination.LogGroupID == "" {
+		return fmt.Sprintf("folder %s", destination.FolderId)
+	}
+	return fmt.Sprintf("log group %s", destination.LogGroupID)
+}
+
+func (d requestDispatcher) dispatch(reqModel *dto.YCLogRecordRequestModel) error {
+	var destination logging.Destination
+	if reqModel.Destination.FolderId != "" {
+		destination.Destination = &logging.Destination_FolderId{FolderId: reqModel.Destination.FolderId}
+	} else {
+		destination.Destination = &logging.Destination_LogGroupId{LogGroupId: reqModel.Destination.LogGroupID}
+	}
+
+	wResource := &logging.LogEntryResource{
+		Type: reqModel.Resource.Type,
+		Id:   reqModel.Resource.ID,
+	}
+
+	var wEntries []*logging.IncomingLogEntry
+	var sources []*dto.YCLogRecordEntry
+	for _, e := range reqModel.Entries {
+		nStruct, err := toStruct(e.JsonPayload)
+		if err != nil {
+			log.Errorln(errors.Wrapf(err, "cannot prepare struct for incomingLogEntry"))
+			d.metrics.conversionFailed(reqModel.Destination)
+			d.deadLetterEntries(fmt.Sprintf("conversion failed: %v", err), reqModel, []*dto.YCLogRecordEntry{e})
+			e.Done()
+			continue
+		}
+		we := &logging.IncomingLogEntry{
+			Timestamp:   timestamppb.New(e.Timestamp),
+			Level:       logging.LogLevel_Level(logging.LogLevel_Level_value[e.Level]),
+			Message:     validUTF8(e.Message),
+			JsonPayload: nStruct,
+			StreamName:  e.StreamName,
+		}
+
+		wEntries = append(wEntries, we)
+		sources = append(sources, e)
+	}
+
+	// every sub-batch repeats destination, resource and defaults, so their size is reserved in each request
+	headerSize := d.headerSize(&logging.WriteRequest{Destination: &destination, Resource: wResource, Defaults: d.defaults})
+	if d.config.MaxRequestBytes > 0 && headerSize >= d.config.MaxRequestBytes {
+		// no entry fits into the request, the limit would not be enforced by splitBatches
+		err := errors.Wrapf(ErrInvalidValue, "max_request_bytes `%d` is not larger than %d bytes of the request without entries",
+			d.config.MaxRequestBytes, headerSize)
+		d.metrics.entriesDropped(reqModel.Destination, dropReasonInvalidRequest, len(sources))
+		d.deadLetterEntries(err.Error(), reqModel, sources)
+		entriesDone(sources)
+		return permanentError{err: err}
+	}
+	batches := splitBatches(len(wEntries), func(idx int) int {
+		return d.entrySize(wEntries[idx])
+	}, d.config.MaxRequestEntries, d.config.MaxRequestBytes-headerSize)
+
+	var lastErr error
+	var rejected []rejectedEntry
+	failedBatches, permanentFailures, sentEntries := 0, 0, 0
+	for idx, batch := range batches {
+		wr := &logging.WriteRequest{}
+		wr.SetDestination(&destination)
+		wr.SetResource(wResource)
+		wr.SetDefaults(d.defaults)
+		wr.SetEntries(wEntries[batch.start:batch.end])
+
+		var response *logging.WriteResponse
+		var err error
+		if d.spool != nil && !d.spool.Empty() {
+			// batches go to the spool while it is replayed to keep their order
+			if err = d.spoolRequest(wr); err == nil {
+				log.Debugf("[yandexcloud %d] batch %d/%d of %d entries spooled until replay is finished",
+					d.config.PluginInstanceId, idx+1, len(batches), len(wr.Entries))
+				entriesDone(sources[batch.start:batch.end])
+				continue
+			}
+		} else {
+			response, err = d.writeWithRetry(wr)
+			if err != nil && d.spool != nil && !errors.Is(err, ErrPermanent) {
+				spoolErr := d.spoolRequest(wr)
+				if spoolErr == nil {
+					log.Warnf("[yandexcloud %d] batch %d/%d of %d entries spooled to be replayed later: %v",
+						d.config.PluginInstanceId, idx+1, len(batches), len(wr.Entries), err)
+					entriesDone(sources[batch.start:batch.end])
+					continue
+				}
+				log.Errorf("[yandexcloud %d] unable to spool failed batch: %v", d.config.PluginInstanceId, spoolErr)
+			}
+		}
+		if err != nil {
+			log.Errorf("[yandexcloud %d] batch %d/%d of %d entries failed: %v",
+				d.config.PluginInstanceId, idx+1, len(batches), len(wr.Entries), err)
+			failedBatches++
+			if errors.Is(err, ErrPermanent) {
+				d.metrics.entriesDropped(reqModel.Destination, dropReasonPermanentFailure, len(wr.Entries))
+				d.deadLetterEntries(fmt.Sprintf("request failed: %v", err), reqModel, sources[batch.start:batch.end])
+				entriesDone(sources[batch.start:batch.end])
+				permanentFailures++
+			} else if d.config.Async {
+				// fluent-bit considers events of async chunks delivered and doesn't retry them
+				d.metrics.entriesDropped(reqModel.Destination, dropReasonRetriesExhausted, len(wr.Entries))
+				d.deadLetterEntries(fmt.Sprintf("request failed after retries: %v", err), reqModel, sources[batch.start:batch.end])
+				entriesDone(sources[batch.start:batch.end])
+			}
+			lastErr = err
+			continue
+		}
+		sentEntries += len(wr.Entries)
+		rejectedCount := countRejectedEntries(response, len(wr.Entries))
+		d.metrics.entriesSent(reqModel.Destination, len(wr.Entries)-rejectedCount)
+		d.metrics.entriesRejected(reqModel.Destination, rejectedCount)
+		for entryIdx, st := range response.GetErrors() {
+			if entryIdx < 0 || int(entryIdx) >= batch.end-batch.start {
+				log.Errorf("[yandexcloud %d] batch %d/%d of %d entries: server rejected unknown entry %d: code %d: %s",
+					d.config.PluginInstanceId, idx+1, len(batches), len(wr.Entries), entryIdx, st.GetCode(), st.GetMessage())
+				continue
+			}
+			rejected = append(rejected, rejectedEntry{
+				entry:       sources[batch.start+int(entryIdx)],
+				destination: reqModel.Destination,
+				resource:    reqModel.Resource,
+				reason:      fmt.Sprintf("code %d: %s", st.GetCode(), st.GetMessage()),
+			})
+		}
+		log.Debugf("[yandexcloud %d] batch %d/%d of %d entries sent, %d rejected",
+			d.config.PluginInstanceId, idx+1, len(batches), len(wr.Entries), rejectedCount)
+		for entryIdx, e := range sources[batch.start:batch.end] {
+			// with partial_failure_policy `retry` only rejected entries are sent again
+			if _, ok := response.GetErrors()[int64(entryIdx)]; !ok || d.config.PartialFailurePolicy != PartialFailurePolicyRetry {
+				e.Done()
+			}
+		}
+	}
+
+	rejectedErr := handleRejectedEntries(d.config, d.rejectedFallback, sentEntries, rejected)
+	if failedBatches > 0 {
+		err := errors.Wrapf(lastErr, "%d of %d batches failed", failedBatches, len(batches))
+		// a chunk is retried as a whole, so it is dropped only if there is nothing to gain from retry
+		if permanentFailures == failedBatches {
+			return permanentError{err: err}
+		}
+		return err
+	}
+	return rejectedErr
+}
+
+// writeWithRetry sends the request, retrying it on transient failures according to the retry policy
+func (d requestDispatcher) writeWithRetry(wr *logging.WriteRequest) (*logging.WriteResponse, error) {
+	var response *logging.WriteResponse
+	destination := writeRequestDestination(wr)
+	attempt := 0
+	err := d.retryPolicy.do(d.parentCtx, func() error {
+		attempt++
+		if attempt > 1 {
+			log.Warnf("[yandexcloud %d] retrying write request, attempt %d", d.config.PluginInstanceId, attempt)
+			d.metrics.retried(destination)
+		}
+		// headerSize of the request with entries is the size of the whole request
+		waited, err := d.limiter.Wait(d.parentCtx, len(wr.Entries), d.headerSize(wr))
+		d.metrics.rateLimited(destination, waited)
+		if err != nil {
+			return err
+		}
+		ctx, cancelFn := context.WithTimeout(d.parentCtx, d.requestTimeout)
+		defer cancelFn()
+		start := time.Now()
+		response, err = d.write(ctx, wr)
+		d.metrics.observeRequest(destination, time.Since(start))
+		if d.limiter.Observe(err) {
+			log.Warnf("[yandexcloud %d] rate limit adjusted to %.1f%% of the configured rate",
+				d.config.PluginInstanceId, d.limiter.Factor()*100)
+		}
+		return err
+	})
+	return response, err
+}
+
+// entriesDone marks entries which must not be sent again, so chunks retried by fluent-bit and batches sent again
+// don't duplicate them
+func entriesDone(entries []*dto.YCLogRecordEntry) {
+	for _, e := range entries {
+		e.Done()
+	}
+}
+
+// countRejectedEntries returns the number of rejected entries of the request. Errors come from the server,
+// so errors of entries the request doesn't have are not counted.
+func countRejectedEntries(response *logging.WriteResponse, entries int) int {
+	count := 0
+	for entryIdx := range response.GetErrors() {
+		if entryIdx >= 0 && int(entryIdx) < entries {
+			count++
+		}
+	}
+	return count
+}
+
+// writeRequestDestination returns the destination of the write request
+func writeRequestDestination(wr *logging.WriteRequest) dto.YCLogRecordDestination {
+	return dto.YCLogRecordDestination{
+		LogGroupID: wr.GetDestination().GetLogGroupId(),
+		FolderId:   wr.GetDestination().GetFolderId(),
+	}
+}
+
+// deadLetterEntries writes entries of the request model into the dead letter file
+func (d requestDispatcher) deadLetterEntries(reason string, reqModel *dto.YCLogRecordRequestModel, entries []*dto.YCLogRecordEntry) {
+	if d.deadLetter == nil {
+		return
+	}
+	records := make([]deadLetterRecord, 0, len(entries))
+	for _, e := range entries {
+		records = append(records, newDeadLetterRecord(reason, reqModel.Destination, reqModel.Resource, e))
+	}
+	d.deadLetter.Write(records)
+}
+
+// open starts the metrics server if metrics_listen is set, opens the dead letter file if dead_letter_path is set
+// and the spool of failed batches if spool_dir is set, the spool is replayed in background
+func (d *requestDispatcher) open() error {
+	if d.config.MetricsListen != "" {
+		if err := acquireMetricsServer(d.config.MetricsListen); err != nil {
+			return err
+		}
+	}
+
+	if d.config.DeadLetterPath != "" {
+		deadLetter, err := openDeadLetterFile(d.config)
+		if err != nil {
+			d.releaseMetricsServer()
+			return err
+		}
+		d.deadLetter = deadLetter
+		d.rejectedFallback = newRejectedEntriesFallback(d.config, deadLetter)
+	}
+
+	if d.config.SpoolDir == "" {
+		return nil
+	}
+	spool, err := openDiskSpool(d.config)
+	if err != nil {
+		d.deadLetter.Close()
+		d.releaseMetricsServer()
+		return err
+	}
+	d.spool = spool
+	d.metrics.setSpoolSize(spool.Size())
+	d.replayDone = make(chan struct{})
+	if !spool.Empty() {
+		log.Infof("[yandexcloud %d] spool contains %d bytes of batches to replay", d.config.PluginInstanceId, spool.Size())
+	}
+	go d.replaySpool(d.replayDone)
+	return nil
+}
+
+// close waits for the replay to stop, closes the spool and the dead letter file and stops the metrics server
+// unless other instances use it, the parent context must be canceled before
+func (d requestDispatcher) close() error {
+	var spoolErr error
+	if d.spool != nil {
+		<-d.replayDone
+		spoolErr = d.spool.Close()
+	}
+	d.releaseMetricsServer()
+	if err := d.deadLetter.Close(); err != nil {
+		return err
+	}
+	return spoolErr
+}
+
+func (d requestDispatcher) releaseMetricsServer() {
+	if d.config.MetricsListen == "" {
+		return
+	}
+	if err := releaseMetricsServer(d.config.MetricsListen); err != nil {
+		log.Errorf("[yandexcloud %d] unable to stop metrics server: %v", d.config.PluginInstanceId, err)
+	}
+}
+
+func (d requestDispatcher) spoolRequest(wr *logging.WriteRequest) error {
+	data, err := proto.Marshal(wr)
+	if err != nil {
+		return err
+	}
+	err = d.spool.Append(data)
+	d.metrics.setSpoolSize(d.spool.Size())
+	return err
+}
+
+// replaySpool sends spooled batches in the order they were spooled until the parent context is canceled.
+// A batch is removed from the spool only after it is sent or failed permanently.
+func (d requestDispatcher) replaySpool(done chan struct{}) {
+	defer close(done)
+	for {
+		data, next, err := d.spool.Peek()
+		if err != nil {
+			log.Errorf("[yandexcloud %d] unable to read spool: %v", d.config.PluginInstanceId, err)
+			if !d.waitReplay(nil) {
+				return
+			}
+			continue
+		}
+		if data == nil {
+			if !d.waitReplay(d.spool.Notify()) {
+				return
+			}
+			continue
+		}
+
+		wr := &logging.WriteRequest{}
+		if err := proto.Unmarshal(data, wr); err != nil {
+			log.Errorf("[yandexcloud %d] spooled batch is dropped, unable to unmarshal it: %v", d.config.PluginInstanceId, err)
+		} else {
+			response, err := d.writeWithRetry(wr)
+			switch {
+			case err != nil && !errors.Is(err, ErrPermanent):
+				log.Warnf("[yandexcloud %d] replay of spooled batch of %d entries failed, retrying in %s: %v",
+					d.config.PluginInstanceId, len(wr.Entries), d.replayInterval(), err)
+				if !d.waitReplay(nil) {
+					return
+				}
+				continue
+			case err != nil:
+				log.Errorf("[yandexcloud %d] spooled batch of %d entries is dropped: %v", d.config.PluginInstanceId, len(wr.Entries), err)
+				d.metrics.entriesDropped(writeRequestDestination(wr), dropReasonPermanentFailure, len(wr.Entries))
+				d.deadLetter.Write(newDeadLetterRecords(fmt.Sprintf("request failed: %v", err), wr))
+			case len(response.GetErrors()) > 0:
+				rejectedCount := countRejectedEntries(response, len(wr.Entries))
+				log.Errorf("[yandexcloud %d] %d of %d replayed entries rejected", d.config.PluginInstanceId, rejectedCount, len(wr.Entries))
+				d.metrics.entriesSent(writeRequestDestination(wr), len(wr.Entries)-rejectedCount)
+				d.metrics.entriesRejected(writeRequestDestination(wr), rejectedCount)
+				d.deadLetterRejected(wr, response)
+			default:
+				d.metrics.entriesSent(writeRequestDestination(wr), len(wr.Entries))
+				log.Debugf("[yandexcloud %d] spooled batch of %d entries replayed", d.config.PluginInstanceId, len(wr.Entries))
+			}
+		}
+
+		if err := d.spool.Ack(next); err != nil {
+			log.Errorf("[yandexcloud %d] unable to store spool replay position: %v", d.config.PluginInstanceId, err)
+		}
+		d.metrics.setSpoolSize(d.spool.Size())
+	}
+}
+
+// deadLetterRejected writes entries of the replayed request rejected by Yandex Cloud Logging into the dead letter file
+func (d requestDispatcher) deadLetterRejected(wr *logging.WriteRequest, response *logging.WriteResponse) {
+	if d.deadLetter == nil || d.config.RejectedEntriesFallback != RejectedFallbackDeadLetter {
+		return
+	}
+	records := newDeadLetterRecords("", wr)
+	var rejected []deadLetterRecord
+	for entryIdx, st := range response.GetErrors() {
+		if entryIdx < 0 || int(entryIdx) >= len(records) {
+			continue
+		}
+		record := records[entryIdx]
+		record.Reason = fmt.Sprintf("rejected: code %d: %s", st.GetCode(), st.GetMessage())
+		rejected = append(rejected, record)
+	}
+	d.deadLetter.Write(rejected)
+}
+
+func (d requestDispatcher) replayInterval() time.Duration {
+	if d.config.SpoolReplayInterval <= 0 {
+		return defaultSpoolReplayInterval
+	}
+	return d.config.SpoolReplayInterval
+}
+
+// waitReplay waits for the replay interval or the notification, false is returned if the replay should stop
+func (d requestDispatcher) waitReplay(notify <-chan struct{}) bool {
+	timer := time.NewTimer(d.replayInterval())
+	defer timer.Stop()
+	select {
+	case <-d.parentCtx.Done():
+		return false
+	case <-notify:
+		return true
+	case <-timer.C:
+		return true
+	}
+}
@@ -21,7 +21,18 @@ type YCLogRecordEntry struct {
 	Timestamp   time.Time                   `json:"timestamp" validate:"required"`
 	Level       string                      `json:"level"`
 	Message     string                      `json:"message"`
+	StreamName  string                      `json:"streamName,omitempty"`
+	Tag         string                      `json:"-"`
 	JsonPayload map[interface{}]interface{} `json:"jsonPayload" validate:"required"`
+	// OnDone is called when the entry must not be sent again: it is written, spooled or dropped
+	OnDone func() `json:"-"`
+}
+
+// Done calls OnDone of the entry if it is set
+func (e *YCLogRecordEntry) Done() {
+	if e.OnDone != nil {
+		e.OnDone()
+	}
 }
 
 type YCLogRecordRequestModel struct {
@@ -0,0 +1,118 @@
+package plugin
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	"yandex_logging/plugin/dto"
+)
+
+// requestGroup identifies events which are sent in the same request
+type requestGroup struct {
+	destination dto.YCLogRecordDestination
+	resource    dto.YCLogRecordResource
+}
+
+// newRequestModels converts events into request models, picking level, message and timestamp out of the records.
+// Events are grouped by destination and resource into separate request models, events with unresolved destination
+// go to log_group_id or folder_id.
+func newRequestModels(config OutputPluginConfig, levels levelMapper, messages messageBuilder, events []*Event) []*dto.YCLogRecordRequestModel {
+	router := newDestinationRouter(config)
+	redactor := newRedactor(config)
+	defaultDestination := dto.YCLogRecordDestination{LogGroupID: config.LogGroupId, FolderId: config.FolderId}
+
+	var models []*dto.YCLogRecordRequestModel
+	groups := make(map[requestGroup]*dto.YCLogRecordRequestModel)
+	for _, e := range events {
+		if e.done {
+			continue
+		}
+		destination, ok := router.Route(e)
+		if !ok {
+			destination = defaultDestination
+		}
+		group := requestGroup{destination: destination, resource: resolveResource(config, e)}
+
+		model, ok := groups[group]
+		if !ok {
+			model = &dto.YCLogRecordRequestModel{
+				Destination: group.destination,
+				Resource:    group.resource,
+			}
+			groups[group] = model
+			models = append(models, model)
+		}
+		model.Entries = append(model.Entries, newLogRecordEntry(config, levels, messages, redactor, e))
+	}
+	return models
+}
+
+// newLogRecordEntry converts the event into the entry. The record of the event is not changed, fields picked out
+// of it are removed from a copy, so the event can be converted again, e.g. when the batch is sent again.
+func newLogRecordEntry(config OutputPluginConfig, levels levelMapper, messages messageBuilder, redactor redactor, e *Event) *dto.YCLogRecordEntry {
+	// stream name is resolved before fields are removed, so stream_name_key may be excluded from the payload
+	streamName := resolveStreamName(config, e)
+	source := e
+	e = &Event{Timestamp: e.Timestamp, Record: copyRecord(e.Record), Tag: e.Tag}
+
+	logLevelVal := logging.LogLevel_LEVEL_UNSPECIFIED.String()
+	rawLevel, err := e.PopLogLevel(e.Record, config.LogLevelKey)
+	if err != nil {
+		log.Errorln(err)
+	} else {
+		logLevelVal = levels.Map(rawLevel).String()
+	}
+
+	message, err := messages.Build(e)
+	if err != nil {
+		log.Errorln(err)
+	}
+
+	ts := e.Timestamp
+	if config.TimeKey != "" {
+		recordTs, err := e.PopTimestamp(e.Record, config.TimeKey, config.TimeFormat)
+		if err != nil {
+			log.Errorln(err)
+		} else {
+			ts = recordTs
+		}
+	}
+
+	payload := buildPayload(config, e.Record)
+	redactor.RedactPayload(payload)
+
+	return &dto.YCLogRecordEntry{
+		Timestamp:   ts,
+		Level:       logLevelVal,
+		JsonPayload: payload,
+		Message:     redactor.RedactMessage(message),
+		StreamName:  streamName,
+		Tag:         e.Tag,
+		OnDone:      func() { source.done = true },
+	}
+}
+
+// copyRecord returns a deep copy of the record maps and arrays, other values are not changed in place and are shared
+func copyRecord(record map[interface{}]interface{}) map[interface{}]interface{} {
+	if record == nil {
+		return nil
+	}
+	c := make(map[interface{}]interface{}, len(record))
+	for k, v := range record {
+		c[k] = copyRecordValue(v)
+	}
+	return c
+}
+
+func copyRecordValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		return copyRecord(t)
+	case []interface{}:
+		values := make([]interface{}, len(t))
+		for idx, val := range t {
+			values[idx] = copyRecordValue(val)
+		}
+		return values
+	}
+	return v
+}
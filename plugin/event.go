@@ -3,17 +3,58 @@ package plugin
 import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"math"
+	"sort"
+	"strconv"
 	"time"
 )
 
+const (
+	// TimeFormatUnix and others below are time_format values for epoch timestamps of different precision
+	TimeFormatUnix      = "unix"
+	TimeFormatUnixMilli = "unix_ms"
+	TimeFormatUnixMicro = "unix_us"
+	TimeFormatUnixNano  = "unix_ns"
+)
+
 type Event struct {
 	Timestamp time.Time
 	Record    map[interface{}]interface{}
 	Tag       string
+	// done is set when the entry of the event must not be sent again. Events kept in the batch
+	// or retried by fluent-bit are sent again without done ones, so they are not duplicated.
+	done bool
 }
 
 // PopLogLevel returns the value associated with the input key from the record map, or an error if the key is not found.
+// Numeric and byte string values are converted into strings.
 func (e *Event) PopLogLevel(record map[interface{}]interface{}, logLevelKey string) (string, error) {
+	key, val, ok := findRecordKey(record, logLevelKey)
+	if !ok {
+		return "", fmt.Errorf("failed to find key '%s' specified by log_level_key option in log record with keys %v", logLevelKey, recordKeys(record))
+	}
+
+	var level string
+	switch t := val.(type) {
+	case string:
+		level = t
+	case []byte:
+		level = string(t)
+	case int64:
+		level = strconv.FormatInt(t, 10)
+	case uint64:
+		level = strconv.FormatUint(t, 10)
+	case float64:
+		level = strconv.FormatFloat(t, 'f', -1, 64)
+	default:
+		return "", fmt.Errorf("could cast log level key of type %T", val)
+	}
+	delete(record, key)
+	return level, nil
+}
+
+func (e *Event) PopMessageKey(record map[interface{}]interface{}, messageKey string) (string, error) {
+
 	for key, val := range record {
 		var currentKey string
 		switch t := key.(type) {
@@ -26,24 +67,113 @@ func (e *Event) PopLogLevel(record map[interface{}]interface{}, logLevelKey stri
 			continue
 		}
 
-		if logLevelKey == currentKey {
-			logKeyCasted, ok := val.(string)
-			if !ok {
-				return "", fmt.Errorf("could cast log level key")
+		if messageKey == currentKey {
+			v, ok := val.(string)
+			if ok {
+				delete(record, key)
+				return v, nil
 			}
-			delete(record, key)
-			return logKeyCasted, nil
+			return "", fmt.Errorf("could not cast message key to string")
 		}
 	}
 
-	return "", fmt.Errorf("failed to find key '%s' specified by log_level_key option in log record: %v", logLevelKey, record)
+	return "", fmt.Errorf("failed to find key '%s; specified by message_key option in log record with keys %v", messageKey, recordKeys(record))
 }
 
-func (e *Event) PopMessageKey(record map[interface{}]interface{}, messageKey string) (string, error) {
+// PopTimestamp parses the value associated with the input key from the record map and removes it from the record.
+// timeFormat is either Go time layout for string values or one of unix time formats for numeric values.
+func (e *Event) PopTimestamp(record map[interface{}]interface{}, timeKey, timeFormat string) (time.Time, error) {
+	key, val, ok := findRecordKey(record, timeKey)
+	if !ok {
+		return time.Time{}, fmt.Errorf("failed to find key '%s' specified by time_key option in log record with keys %v", timeKey, recordKeys(record))
+	}
 
-	for key, val := range record {
+	var ts time.Time
+	var err error
+	switch t := val.(type) {
+	case string:
+		ts, err = parseTime(t, timeFormat)
+	case []byte:
+		ts, err = parseTime(string(t), timeFormat)
+	case int64:
+		ts = parseUnixIntTime(t, timeFormat)
+	case uint64:
+		ts = parseUnixIntTime(int64(t), timeFormat)
+	case float64:
+		ts = parseUnixTime(t, timeFormat)
+	default:
+		err = fmt.Errorf("unsupported type %T of time key", val)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	delete(record, key)
+	return ts, nil
+}
+
+func parseTime(value, timeFormat string) (time.Time, error) {
+	switch timeFormat {
+	case TimeFormatUnix, TimeFormatUnixMilli, TimeFormatUnixMicro, TimeFormatUnixNano:
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return parseUnixIntTime(i, timeFormat), nil
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("could not parse time `%s` as %s: %v", value, timeFormat, err)
+		}
+		return parseUnixTime(f, timeFormat), nil
+	}
+	ts, err := time.Parse(timeFormat, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse time `%s`: %v", value, err)
+	}
+	return ts, nil
+}
+
+// parseUnixTime converts epoch value into time, value is treated as seconds unless timeFormat says otherwise
+func parseUnixTime(value float64, timeFormat string) time.Time {
+	switch timeFormat {
+	case TimeFormatUnixMilli:
+		value /= 1e3
+	case TimeFormatUnixMicro:
+		value /= 1e6
+	case TimeFormatUnixNano:
+		value /= 1e9
+	}
+	sec, frac := math.Modf(value)
+	return time.Unix(int64(sec), int64(math.Round(frac*1e9)))
+}
+
+// parseUnixIntTime is parseUnixTime for integer values, it keeps precision of nanosecond timestamps
+func parseUnixIntTime(value int64, timeFormat string) time.Time {
+	switch timeFormat {
+	case TimeFormatUnixMilli:
+		return time.Unix(0, value*int64(time.Millisecond))
+	case TimeFormatUnixMicro:
+		return time.Unix(0, value*int64(time.Microsecond))
+	case TimeFormatUnixNano:
+		return time.Unix(0, value)
+	}
+	return time.Unix(value, 0)
+}
+
+// recordKeys returns sorted keys of the record. Errors name the keys instead of printing the record,
+// which may hold sensitive data.
+func recordKeys(record map[interface{}]interface{}) []string {
+	keys := make([]string, 0, len(record))
+	for k := range record {
+		keys = append(keys, toStructKey(k))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// findRecordKey looks up the record key equal to the input one, record keys are either strings or byte slices
+func findRecordKey(record map[interface{}]interface{}, key string) (interface{}, interface{}, bool) {
+	for k, val := range record {
 		var currentKey string
-		switch t := key.(type) {
+		switch t := k.(type) {
 		case []byte:
 			currentKey = string(t)
 		case string:
@@ -53,15 +183,9 @@ func (e *Event) PopMessageKey(record map[interface{}]interface{}, messageKey str
 			continue
 		}
 
-		if messageKey == currentKey {
-			v, ok := val.(string)
-			if ok {
-				delete(record, key)
-				return v, nil
-			}
-			return "", fmt.Errorf("could not cast message key to string")
+		if key == currentKey {
+			return k, val, true
 		}
 	}
-
-	return "", fmt.Errorf("failed to find key '%s; specified by message_key option in log record: %v", messageKey, record)
+	return nil, nil, false
 }
@@ -63,6 +63,26 @@ func TestEvent_GetLogLevel(t *testing.T) {
 		assert.False(t, ok)
 	})
 
+	t.Run("non_string_log_level", func(t *testing.T) {
+		values := []struct {
+			value    interface{}
+			expected string
+		}{
+			{int64(30), "30"},
+			{uint64(6), "6"},
+			{float64(40), "40"},
+			{[]byte("error"), "error"},
+		}
+		for _, v := range values {
+			record := map[interface{}]interface{}{"key1": "val1", "level": v.value}
+			e := Event{Timestamp: time.Now(), Record: record, Tag: "test_tag"}
+
+			m, err := e.PopLogLevel(e.Record, "level")
+			assert.NoError(t, err)
+			assert.Equal(t, v.expected, m)
+		}
+	})
+
 	t.Run("absence_of_log_level", func(t *testing.T) {
 		record := map[interface{}]interface{}{"key1": "val1", "key2": "val2"}
 		e := Event{
@@ -73,7 +93,60 @@ func TestEvent_GetLogLevel(t *testing.T) {
 
 		_, err := e.PopLogLevel(e.Record, "DEBUG")
 		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "[key1 key2]")
+		assert.NotContains(t, err.Error(), "val1", "record values should not be printed")
+
+	})
+
+}
+
+func TestEvent_PopTimestamp(t *testing.T) {
+	expected := time.Date(2021, 8, 20, 10, 15, 30, 123456789, time.UTC)
+	cases := []struct {
+		name       string
+		value      interface{}
+		timeFormat string
+		expected   time.Time
+	}{
+		{"rfc3339nano", "2021-08-20T10:15:30.123456789Z", time.RFC3339Nano, expected},
+		{"custom_layout", []byte("20/08/2021 10:15:30.123456789"), "02/01/2006 15:04:05.999999999", expected},
+		{"unix_float", 1629454530.5, TimeFormatUnix, time.Unix(1629454530, 500000000)},
+		{"unix_int", int64(1629454530), TimeFormatUnix, time.Unix(1629454530, 0)},
+		{"unix_ms", uint64(1629454530123), TimeFormatUnixMilli, time.Unix(1629454530, 123000000)},
+		{"unix_ns", int64(1629454530123456789), TimeFormatUnixNano, expected},
+		{"unix_ns_string", "1629454530123456789", TimeFormatUnixNano, time.Unix(0, 1629454530123456789)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			record := map[interface{}]interface{}{"key1": "val1", "time": c.value}
+			e := Event{Timestamp: time.Now(), Record: record, Tag: "test_tag"}
+
+			ts, err := e.PopTimestamp(e.Record, "time", c.timeFormat)
+			assert.NoError(t, err)
+			assert.True(t, c.expected.Equal(ts), "expected %s, got %s", c.expected, ts)
+
+			_, ok := record["time"]
+			assert.False(t, ok)
+		})
+	}
+
+	t.Run("invalid_time", func(t *testing.T) {
+		record := map[interface{}]interface{}{"time": "yesterday"}
+		e := Event{Timestamp: time.Now(), Record: record, Tag: "test_tag"}
+
+		_, err := e.PopTimestamp(e.Record, "time", time.RFC3339Nano)
+		assert.Error(t, err)
 
+		_, ok := record["time"]
+		assert.True(t, ok, "unparsed time should be kept in the record")
 	})
 
+	t.Run("absence_of_time", func(t *testing.T) {
+		record := map[interface{}]interface{}{"key1": "val1"}
+		e := Event{Timestamp: time.Now(), Record: record, Tag: "test_tag"}
+
+		_, err := e.PopTimestamp(e.Record, "time", time.RFC3339Nano)
+		assert.Error(t, err)
+	})
 }
@@ -2,178 +2,98 @@ package plugin
 
 import (
 	"context"
-	"encoding/json"
-	"github.com/golang/protobuf/ptypes/timestamp"
-	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
 	ycsdk "github.com/yandex-cloud/go-sdk"
-	"github.com/yandex-cloud/go-sdk/iamkey"
 	"google.golang.org/grpc"
-	"google.golang.org/protobuf/types/known/structpb"
-	"io/ioutil"
 	"time"
 	"yandex_logging/plugin/dto"
 )
 
-type iamKey struct {
-	ServiceAccountID string `json:"service_account_id"`
-	ID               string `json:"id"`
-	PrivateKey       string `json:"private_key"`
-}
-
 type grpcLogSender struct {
 	config           OutputPluginConfig
 	doRequestHandler requestHandler
 	authToken        authToken
-	tokenLifetime    time.Duration
 	requestTimeout   time.Duration
 	parentCtx        context.Context
+	cancelFn         context.CancelFunc
 	sdk              *ycsdk.SDK
+	writer           logIngestionWriter
+	dispatcher       requestDispatcher
+	levels           levelMapper
+	messages         messageBuilder
 }
 
 func NewGRPCLogSender(ctx context.Context, config OutputPluginConfig) (*grpcLogSender, error) {
 
-	privateBuffer, err := ioutil.ReadFile(config.PrivateKeyFilePath)
-	if err != nil {
-		return nil, err
-	}
-
-	ikey := &iamKey{
-		ServiceAccountID: config.ServiceAccountID,
-		ID:               config.KeyID,
-		PrivateKey:       string(privateBuffer),
-	}
-
-	iKeyBytes, err := json.Marshal(ikey)
-	if err != nil {
-		return nil, err
-	}
-
-	k, err := iamkey.ReadFromJSONBytes(iKeyBytes)
+	creds, err := newCredentials(config)
 	if err != nil {
 		return nil, err
 	}
 
-	creds, err := ycsdk.ServiceAccountKey(k)
+	messages, err := newMessageBuilder(config)
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancelFn := context.WithCancel(ctx)
 	sdk, err := ycsdk.Build(ctx, ycsdk.Config{
-		Credentials: creds,
+		Credentials:        creds,
+		DialContextTimeout: config.ConnectTimeout,
 	})
 	if err != nil {
+		cancelFn()
 		return nil, err
 	}
 
 	sender := &grpcLogSender{
 		config:         config,
-		tokenLifetime:  time.Minute * 5,
-		requestTimeout: time.Second * 5,
+		requestTimeout: config.requestTimeout(),
 		parentCtx:      ctx,
+		cancelFn:       cancelFn,
 		sdk:            sdk,
+		writer:         sdk.LogIngestion().LogIngestion(),
+		levels:         newLevelMapper(config.LevelMap),
+		messages:       messages,
+	}
+	sender.dispatcher = newRequestDispatcher(ctx, config, sender.requestTimeout, sender.write)
+	if err := sender.dispatcher.open(); err != nil {
+		cancelFn()
+		return nil, err
 	}
 	sender.doRequestHandler = sender.doRequest
 	return sender, nil
 }
 
 func (g *grpcLogSender) Send(events []*Event) error {
-	var entries []*dto.YCLogRecordEntry
-	for _, e := range events {
-		logLevelVal := "LEVEL_UNSPECIFIED"
-
-		logLevelVal, err := e.PopLogLevel(e.Record, g.config.LogLevelKey)
-		if err != nil {
-			log.Errorln(err)
-		}
-
-		message, err := e.PopMessageKey(e.Record, "message")
-		if err != nil {
-			log.Errorln(err)
-		}
-
-		entries = append(entries, &dto.YCLogRecordEntry{
-			Timestamp:   e.Timestamp,
-			Level:       logLevelVal,
-			JsonPayload: e.Record,
-			Message:     message,
-		})
-	}
-
-	reqModel := &dto.YCLogRecordRequestModel{
-		Destination: dto.YCLogRecordDestination{LogGroupID: g.config.LogGroupId, FolderId: g.config.FolderId},
-		Resource:    dto.YCLogRecordResource{ID: g.config.ResourceId, Type: g.config.ResourceType},
-		Entries:     entries,
-	}
-	if err := reqModel.Validate(); err != nil {
-		return err
-	}
-
-	if err := g.doRequestHandler(reqModel); err != nil {
-		return err
-	}
-
-	return nil
+	reqModels := newRequestModels(g.config, g.levels, g.messages, events)
+	return g.dispatcher.sendRequestModels(reqModels, g.doRequestHandler)
 }
 
 func (g *grpcLogSender) doRequest(reqModel *dto.YCLogRecordRequestModel) error {
+	return g.dispatcher.dispatch(reqModel)
+}
 
-	wr := logging.WriteRequest{}
+func (g *grpcLogSender) write(ctx context.Context, wr *logging.WriteRequest) (*logging.WriteResponse, error) {
+	return g.writer.Write(ctx, wr, grpc.EmptyCallOption{})
+}
 
-	var destination logging.Destination
-	if reqModel.Destination.FolderId != "" {
-		destination.Destination = &logging.Destination_FolderId{FolderId: reqModel.Destination.FolderId}
-	} else {
-		destination.Destination = &logging.Destination_LogGroupId{LogGroupId: reqModel.Destination.LogGroupID}
+// Close cancels requests in progress, closes the spool and the dead letter file and shuts down SDK connections
+func (g *grpcLogSender) Close() error {
+	if g.cancelFn != nil {
+		g.cancelFn()
 	}
-	wr.SetDestination(&destination)
-
-	wResource := &logging.LogEntryResource{
-		Type: reqModel.Resource.Type,
-		Id:   reqModel.Resource.ID,
+	if err := g.dispatcher.close(); err != nil {
+		log.Errorf("[yandexcloud %d] unable to close spool or dead letter file: %v", g.config.PluginInstanceId, err)
 	}
-	wr.SetResource(wResource)
-
-	var wEntries []*logging.IncomingLogEntry
-	for _, e := range reqModel.Entries {
-		nStruct, err := structpb.NewStruct(g.convertMap(e.JsonPayload))
-		if err != nil {
-			log.Errorln(errors.Wrapf(err, "cannot prepare struct for incomingLogEntry"))
-			continue
-		}
-		we := &logging.IncomingLogEntry{
-			Timestamp:   &timestamp.Timestamp{Seconds: e.Timestamp.Unix()},
-			Level:       logging.LogLevel_Level(logging.LogLevel_Level_value[e.Level]),
-			Message:     e.Message,
-			JsonPayload: nStruct,
-		}
-
-		wEntries = append(wEntries, we)
+	if g.sdk == nil {
+		return nil
 	}
-	wr.SetEntries(wEntries)
-
-	ctx, cancelFn := context.WithTimeout(g.parentCtx, g.requestTimeout)
+	ctx, cancelFn := context.WithTimeout(context.Background(), g.requestTimeout)
 	defer cancelFn()
-	response, err := g.sdk.LogIngestion().LogIngestion().Write(ctx, &wr, grpc.EmptyCallOption{})
-	if err != nil {
-		return err
-	}
-	log.Infoln(response)
-	return nil
+	return g.sdk.Shutdown(ctx)
 }
 
 func (g *grpcLogSender) getToken() (string, error) {
 	return "", nil
 }
-
-func (g *grpcLogSender) convertMap(m map[interface{}]interface{}) map[string]interface{} {
-	newM := make(map[string]interface{})
-
-	for k, v := range m {
-		if s, ok := k.(string); ok {
-			newM[s] = v
-		}
-	}
-	return newM
-}
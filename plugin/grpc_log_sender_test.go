@@ -2,9 +2,24 @@ package plugin
 
 import (
 	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -18,7 +33,7 @@ func TestGRPCLogSenderSuite(t *testing.T) {
 	suite.Run(t, new(GRPCLogSenderTestSuite))
 }
 
-func (s *GRPCLogSenderTestSuite) SetupSuite() {
+func (s *GRPCLogSenderTestSuite) SetupTest() {
 	s.config = OutputPluginConfig{
 		PluginInstanceId:   0,
 		EndpointUrl:        "test_url",
@@ -68,3 +83,683 @@ func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_Send() {
 	err = sender.Send(events)
 	require.NoError(s.T(), err)
 }
+
+func newTestGRPCLogSender(config OutputPluginConfig, writer logIngestionWriter) *grpcLogSender {
+	if len(config.MessageKeys) == 0 {
+		config.MessageKeys = []string{"message"}
+	}
+	messages, err := newMessageBuilder(config)
+	if err != nil {
+		panic(err)
+	}
+	sender := &grpcLogSender{
+		config:         config,
+		requestTimeout: time.Second * 5,
+		parentCtx:      context.Background(),
+		writer:         writer,
+		levels:         newLevelMapper(config.LevelMap),
+		messages:       messages,
+	}
+	sender.dispatcher = newRequestDispatcher(sender.parentCtx, config, sender.requestTimeout, sender.write)
+	sender.dispatcher.retryPolicy = retryPolicy{maxAttempts: 3}
+	sender.doRequestHandler = sender.doRequest
+	return sender
+}
+
+func newTestEvents(count int, record func(idx int) map[interface{}]interface{}) []*Event {
+	var events []*Event
+	for i := 0; i < count; i++ {
+		events = append(events, &Event{
+			Timestamp: time.Now(),
+			Record:    record(i),
+			Tag:       "test_tag",
+		})
+	}
+	return events
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_SplitByEntries() {
+	config := s.config
+	config.MaxRequestEntries = 2
+	config.MaxRequestBytes = defaultMaxRequestBytes
+
+	writer := &MockLogIngestionWriter{}
+	var batchSizes []int
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(func(args mock.Arguments) {
+		batchSizes = append(batchSizes, len(args.Get(0).(*logging.WriteRequest).Entries))
+	}).Return(&logging.WriteResponse{}, nil)
+
+	sender := newTestGRPCLogSender(config, writer)
+	events := newTestEvents(5, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message", "key1": "value1"}
+	})
+
+	err := sender.Send(events)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), []int{2, 2, 1}, batchSizes)
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_SplitByBytes() {
+	config := s.config
+	config.MaxRequestEntries = defaultMaxRequestEntries
+	config.MaxRequestBytes = 1024
+
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(func(args mock.Arguments) {
+		wr := args.Get(0).(*logging.WriteRequest)
+		assert.LessOrEqual(s.T(), len(wr.Entries), 2)
+	}).Return(&logging.WriteResponse{}, nil)
+
+	sender := newTestGRPCLogSender(config, writer)
+	events := newTestEvents(6, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message", "body": strings.Repeat("x", 400)}
+	})
+
+	err := sender.Send(events)
+	require.NoError(s.T(), err)
+	writer.AssertNumberOfCalls(s.T(), "Write", 3)
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_MaxRequestBytesBelowHeader() {
+	config := s.config
+	config.MaxRequestEntries = defaultMaxRequestEntries
+	config.MaxRequestBytes = 16
+
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(&logging.WriteResponse{}, nil)
+
+	sender := newTestGRPCLogSender(config, writer)
+	events := newTestEvents(2, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message"}
+	})
+
+	err := sender.Send(events)
+	assert.True(s.T(), errors.Is(err, ErrPermanent))
+	assert.True(s.T(), errors.Is(err, ErrInvalidValue))
+	writer.AssertNumberOfCalls(s.T(), "Write", 0)
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_FailedBatchReported() {
+	config := s.config
+	config.MaxRequestEntries = 2
+	config.MaxRequestBytes = defaultMaxRequestBytes
+
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(&logging.WriteResponse{}, nil).Once()
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(nil, fmt.Errorf("some write error")).Once()
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(&logging.WriteResponse{}, nil).Once()
+
+	sender := newTestGRPCLogSender(config, writer)
+	events := newTestEvents(5, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message"}
+	})
+
+	err := sender.Send(events)
+	assert.Error(s.T(), err)
+	writer.AssertNumberOfCalls(s.T(), "Write", 3)
+}
+
+type recordingRejectedFallback struct {
+	entries []rejectedEntry
+}
+
+func (f *recordingRejectedFallback) handle(entries []rejectedEntry) {
+	f.entries = append(f.entries, entries...)
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_PartialFailure() {
+	policies := map[string]error{
+		PartialFailurePolicyIgnore: nil,
+		PartialFailurePolicyRetry:  ErrPartialFailure,
+	}
+
+	for policy, expectedErr := range policies {
+		config := s.config
+		config.MaxRequestEntries = 2
+		config.MaxRequestBytes = defaultMaxRequestBytes
+		config.PartialFailurePolicy = policy
+
+		writer := &MockLogIngestionWriter{}
+		writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(&logging.WriteResponse{}, nil).Once()
+		writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(&logging.WriteResponse{
+			Errors: map[int64]*status.Status{1: {Code: 3, Message: "entry is too large"}},
+		}, nil).Once()
+
+		fallback := &recordingRejectedFallback{}
+		sender := newTestGRPCLogSender(config, writer)
+		sender.dispatcher.rejectedFallback = fallback
+		events := newTestEvents(4, func(idx int) map[interface{}]interface{} {
+			return map[interface{}]interface{}{"message": fmt.Sprintf("test_message_%d", idx)}
+		})
+
+		err := sender.Send(events)
+		if expectedErr == nil {
+			assert.NoError(s.T(), err, policy)
+		} else {
+			assert.True(s.T(), errors.Is(err, expectedErr), policy)
+		}
+		require.Equal(s.T(), 1, len(fallback.entries), policy)
+		assert.Equal(s.T(), "test_message_3", fallback.entries[0].entry.Message, policy)
+		assert.Equal(s.T(), "code 3: entry is too large", fallback.entries[0].reason, policy)
+	}
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_RejectedUnknownEntry() {
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(&logging.WriteResponse{
+		Errors: map[int64]*status.Status{
+			-1: {Code: 3, Message: "negative index"},
+			1:  {Code: 3, Message: "entry is too large"},
+			7:  {Code: 3, Message: "out of range"},
+		},
+	}, nil).Once()
+
+	fallback := &recordingRejectedFallback{}
+	sender := newTestGRPCLogSender(s.config, writer)
+	sender.dispatcher.rejectedFallback = fallback
+	events := newTestEvents(2, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": fmt.Sprintf("test_message_%d", idx)}
+	})
+
+	assert.NotPanics(s.T(), func() { _ = sender.Send(events) })
+	require.Equal(s.T(), 1, len(fallback.entries), "entries with unknown indexes should be skipped")
+	assert.Equal(s.T(), "test_message_1", fallback.entries[0].entry.Message)
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_RetryTransientError() {
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.Unavailable, "unavailable")).Twice()
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(&logging.WriteResponse{}, nil).Once()
+
+	sender := newTestGRPCLogSender(s.config, writer)
+	events := newTestEvents(3, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message"}
+	})
+
+	err := sender.Send(events)
+	assert.NoError(s.T(), err)
+	writer.AssertNumberOfCalls(s.T(), "Write", 3)
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_RetryAttemptsExhausted() {
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.ResourceExhausted, "quota exceeded"))
+
+	sender := newTestGRPCLogSender(s.config, writer)
+	events := newTestEvents(3, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message"}
+	})
+
+	err := sender.Send(events)
+	assert.Error(s.T(), err)
+	assert.False(s.T(), errors.Is(err, ErrPermanent), "transient error should be retried by fluent-bit")
+	writer.AssertNumberOfCalls(s.T(), "Write", 3)
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_PermanentErrorFailsFast() {
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.PermissionDenied, "permission denied"))
+
+	sender := newTestGRPCLogSender(s.config, writer)
+	events := newTestEvents(3, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message"}
+	})
+
+	err := sender.Send(events)
+	assert.True(s.T(), errors.Is(err, ErrPermanent))
+	writer.AssertNumberOfCalls(s.T(), "Write", 1)
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_NanosecondTimestamp() {
+	eventTime := time.Date(2021, 8, 20, 10, 15, 30, 123456789, time.UTC)
+	recordTime := time.Date(2021, 8, 20, 10, 15, 31, 987654321, time.UTC)
+
+	writer := &MockLogIngestionWriter{}
+	var entries []*logging.IncomingLogEntry
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(func(args mock.Arguments) {
+		entries = args.Get(0).(*logging.WriteRequest).Entries
+	}).Return(&logging.WriteResponse{}, nil)
+
+	config := s.config
+	config.TimeKey = "time"
+	config.TimeFormat = time.RFC3339Nano
+	sender := newTestGRPCLogSender(config, writer)
+
+	events := []*Event{
+		{Timestamp: eventTime, Record: map[interface{}]interface{}{"message": "event time"}},
+		{Timestamp: eventTime, Record: map[interface{}]interface{}{
+			"message": "record time",
+			"time":    recordTime.Format(time.RFC3339Nano),
+		}},
+	}
+
+	err := sender.Send(events)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 2, len(entries))
+	assert.True(s.T(), eventTime.Equal(entries[0].Timestamp.AsTime()))
+	assert.True(s.T(), recordTime.Equal(entries[1].Timestamp.AsTime()))
+	_, ok := entries[1].JsonPayload.Fields["time"]
+	assert.False(s.T(), ok, "time key should be removed from payload")
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_LevelMapping() {
+	writer := &MockLogIngestionWriter{}
+	var entries []*logging.IncomingLogEntry
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(func(args mock.Arguments) {
+		entries = args.Get(0).(*logging.WriteRequest).Entries
+	}).Return(&logging.WriteResponse{}, nil)
+
+	config := s.config
+	config.LevelMap = map[string]logging.LogLevel_Level{"verbose": logging.LogLevel_TRACE}
+	sender := newTestGRPCLogSender(config, writer)
+
+	levels := []interface{}{"info", "Warning", "ERR", int64(3), uint64(50), "verbose", "unknown"}
+	expected := []logging.LogLevel_Level{
+		logging.LogLevel_INFO, logging.LogLevel_WARN, logging.LogLevel_ERROR, logging.LogLevel_ERROR,
+		logging.LogLevel_ERROR, logging.LogLevel_TRACE, logging.LogLevel_LEVEL_UNSPECIFIED,
+	}
+	events := newTestEvents(len(levels), func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message", config.LogLevelKey: levels[idx]}
+	})
+
+	err := sender.Send(events)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), len(expected), len(entries))
+	for idx, e := range entries {
+		assert.Equal(s.T(), expected[idx], e.Level, "level `%v`", levels[idx])
+	}
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_RouteByRecordAndTag() {
+	config := s.config
+	config.FolderId = ""
+	config.LogGroupIdKey, _ = parseRecordAccessor("$kubernetes['namespace_name']")
+	config.TagLogGroupMap, _ = parseTagLogGroupMap(`kube\.system\..*:system_group`)
+
+	writer := &MockLogIngestionWriter{}
+	entriesByGroup := make(map[string]int)
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(func(args mock.Arguments) {
+		wr := args.Get(0).(*logging.WriteRequest)
+		entriesByGroup[wr.GetDestination().GetLogGroupId()] += len(wr.Entries)
+	}).Return(&logging.WriteResponse{}, nil)
+
+	sender := newTestGRPCLogSender(config, writer)
+	namespaces := []string{"ns1", "ns2", "ns1", "", "", "ns2"}
+	events := newTestEvents(len(namespaces), func(idx int) map[interface{}]interface{} {
+		record := map[interface{}]interface{}{"message": "test_message"}
+		if namespaces[idx] != "" {
+			record["kubernetes"] = map[interface{}]interface{}{"namespace_name": namespaces[idx]}
+		}
+		return record
+	})
+	events[4].Tag = "kube.system.dns"
+
+	err := sender.Send(events)
+	require.NoError(s.T(), err)
+	writer.AssertNumberOfCalls(s.T(), "Write", 4)
+	assert.Equal(s.T(), map[string]int{
+		"ns1":               2,
+		"ns2":               2,
+		"system_group":      1,
+		"test_log_group_id": 1,
+	}, entriesByGroup)
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_RouteFailedDestination() {
+	config := s.config
+	config.LogGroupIdKey, _ = parseRecordAccessor("log_group")
+
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.MatchedBy(func(wr *logging.WriteRequest) bool {
+		return wr.GetDestination().GetLogGroupId() == "forbidden_group"
+	})).Return(nil, grpcstatus.Error(codes.PermissionDenied, "permission denied"))
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(&logging.WriteResponse{}, nil)
+
+	sender := newTestGRPCLogSender(config, writer)
+	events := newTestEvents(2, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message", "log_group": []string{"allowed_group", "forbidden_group"}[idx]}
+	})
+
+	err := sender.Send(events)
+	assert.True(s.T(), errors.Is(err, ErrPermanent))
+	writer.AssertNumberOfCalls(s.T(), "Write", 2)
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_GroupByResource() {
+	config := s.config
+	config.ResourceType = "k8s.pod"
+	config.ResourceIdKey, _ = parseRecordAccessor("kubernetes.pod_name")
+
+	writer := &MockLogIngestionWriter{}
+	entriesByResource := make(map[string]int)
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(func(args mock.Arguments) {
+		wr := args.Get(0).(*logging.WriteRequest)
+		assert.Equal(s.T(), "k8s.pod", wr.GetResource().GetType())
+		entriesByResource[wr.GetResource().GetId()] += len(wr.Entries)
+	}).Return(&logging.WriteResponse{}, nil)
+
+	sender := newTestGRPCLogSender(config, writer)
+	pods := []string{"pod-a", "pod-b", "pod-a", ""}
+	events := newTestEvents(len(pods), func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			"message":    "test_message",
+			"kubernetes": map[interface{}]interface{}{"pod_name": pods[idx]},
+		}
+	})
+
+	err := sender.Send(events)
+	require.NoError(s.T(), err)
+	writer.AssertNumberOfCalls(s.T(), "Write", 3)
+	assert.Equal(s.T(), map[string]int{"pod-a": 2, "pod-b": 1, "test_resource_id": 1}, entriesByResource)
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_StreamName() {
+	config := s.config
+	config.StreamNameFromTag = true
+
+	writer := &MockLogIngestionWriter{}
+	var streamNames []string
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(func(args mock.Arguments) {
+		for _, entry := range args.Get(0).(*logging.WriteRequest).Entries {
+			streamNames = append(streamNames, entry.GetStreamName())
+		}
+	}).Return(&logging.WriteResponse{}, nil)
+
+	sender := newTestGRPCLogSender(config, writer)
+	events := newTestEvents(2, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message"}
+	})
+	events[1].Tag = "kube.app/stderr"
+
+	err := sender.Send(events)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), []string{"test_tag", "kube.app_stderr"}, streamNames)
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_StreamNameKeyExcluded() {
+	config := s.config
+	config.StreamNameKey, _ = parseRecordAccessor("stream")
+	config.ExcludeKeys = []recordAccessor{config.StreamNameKey}
+	config.RedactKeys = []*regexp.Regexp{regexp.MustCompile("(?i)password")}
+
+	writer := &MockLogIngestionWriter{}
+	var entries []*logging.IncomingLogEntry
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(func(args mock.Arguments) {
+		entries = append(entries, args.Get(0).(*logging.WriteRequest).Entries...)
+	}).Return(&logging.WriteResponse{}, nil)
+
+	sender := newTestGRPCLogSender(config, writer)
+	events := newTestEvents(1, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			"message":   "test_message",
+			"log_level": "ERROR",
+			"stream":    "stderr",
+			"auth":      map[interface{}]interface{}{"password": "qwerty"},
+		}
+	})
+
+	require.NoError(s.T(), sender.Send(events))
+	require.Equal(s.T(), 1, len(entries))
+	assert.Equal(s.T(), "stderr", entries[0].GetStreamName(), "stream name should be resolved before exclude_keys")
+	assert.NotContains(s.T(), entries[0].JsonPayload.Fields, "stream")
+	assert.Equal(s.T(), map[interface{}]interface{}{
+		"message":   "test_message",
+		"log_level": "ERROR",
+		"stream":    "stderr",
+		"auth":      map[interface{}]interface{}{"password": "qwerty"},
+	}, events[0].Record, "record of the event should not be changed")
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_Defaults() {
+	config := s.config
+	config.DefaultLevel = logging.LogLevel_INFO
+	config.DefaultPayload, _ = parseDefaultPayload(`{"cluster": "prod"}`)
+
+	writer := &MockLogIngestionWriter{}
+	var requests []*logging.WriteRequest
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(func(args mock.Arguments) {
+		requests = append(requests, args.Get(0).(*logging.WriteRequest))
+	}).Return(&logging.WriteResponse{}, nil)
+
+	sender := newTestGRPCLogSender(config, writer)
+	events := newTestEvents(2, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message", "key1": "value1"}
+	})
+
+	err := sender.Send(events)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 1, len(requests))
+	assert.Equal(s.T(), logging.LogLevel_INFO, requests[0].GetDefaults().GetLevel())
+	assert.Equal(s.T(), "prod", requests[0].GetDefaults().GetJsonPayload().Fields["cluster"].GetStringValue())
+	for _, entry := range requests[0].Entries {
+		assert.Equal(s.T(), logging.LogLevel_LEVEL_UNSPECIFIED, entry.Level, "entry without level gets the default one")
+		assert.NotContains(s.T(), entry.JsonPayload.Fields, "cluster")
+	}
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_Redaction() {
+	config := s.config
+	config.RedactKeys = []*regexp.Regexp{regexp.MustCompile("(?i)password")}
+	config.RedactValues = []*regexp.Regexp{builtinRedactPatterns["email"]}
+
+	writer := &MockLogIngestionWriter{}
+	var entries []*logging.IncomingLogEntry
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(func(args mock.Arguments) {
+		entries = append(entries, args.Get(0).(*logging.WriteRequest).Entries...)
+	}).Return(&logging.WriteResponse{}, nil)
+
+	sender := newTestGRPCLogSender(config, writer)
+	events := newTestEvents(1, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			"message": "login of john.doe@example.com",
+			"auth":    map[interface{}]interface{}{"password": "qwerty"},
+		}
+	})
+
+	err := sender.Send(events)
+	require.NoError(s.T(), err)
+	require.Equal(s.T(), 1, len(entries))
+	assert.Equal(s.T(), "login of "+defaultRedactMask, entries[0].Message)
+	assert.Equal(s.T(), defaultRedactMask, entries[0].JsonPayload.Fields["auth"].GetStructValue().Fields["password"].GetStringValue())
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_SpoolAndReplay() {
+	config := s.config
+	config.SpoolDir = s.T().TempDir()
+	config.SpoolMaxBytes = defaultSpoolMaxBytes
+	config.SpoolSegmentBytes = defaultSpoolSegmentBytes
+	config.SpoolReplayInterval = time.Millisecond * 10
+
+	var mu sync.Mutex
+	var messages []string
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.Unavailable, "unavailable")).Times(6)
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(func(args mock.Arguments) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, entry := range args.Get(0).(*logging.WriteRequest).Entries {
+			messages = append(messages, entry.Message)
+		}
+	}).Return(&logging.WriteResponse{}, nil)
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	sender := newTestGRPCLogSender(config, writer)
+	sender.parentCtx = ctx
+	sender.cancelFn = cancelFn
+	sender.dispatcher = newRequestDispatcher(ctx, config, sender.requestTimeout, sender.write)
+	sender.dispatcher.retryPolicy = retryPolicy{maxAttempts: 3}
+	require.NoError(s.T(), sender.dispatcher.open())
+
+	for i := 0; i < 2; i++ {
+		events := newTestEvents(1, func(idx int) map[interface{}]interface{} {
+			return map[interface{}]interface{}{"message": fmt.Sprintf("test_message_%d", i)}
+		})
+		require.NoError(s.T(), sender.Send(events), "failed batch should be spooled")
+	}
+
+	assert.Eventually(s.T(), func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(messages) == 2
+	}, time.Second*5, time.Millisecond*10)
+	assert.Equal(s.T(), []string{"test_message_0", "test_message_1"}, messages, "spooled batches should be replayed in order")
+	assert.Eventually(s.T(), sender.dispatcher.spool.Empty, time.Second, time.Millisecond*10)
+	require.NoError(s.T(), sender.Close())
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_DeadLetter() {
+	config := s.config
+	config.MaxRequestEntries = 2
+	config.MaxRequestBytes = defaultMaxRequestBytes
+	config.DeadLetterPath = filepath.Join(s.T().TempDir(), "dead_letter.log")
+	config.DeadLetterMaxBytes = defaultDeadLetterMaxBytes
+	config.DeadLetterMaxFiles = defaultDeadLetterMaxFiles
+	config.RejectedEntriesFallback = RejectedFallbackDeadLetter
+
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(&logging.WriteResponse{
+		Errors: map[int64]*status.Status{1: {Code: 3, Message: "entry is too large"}},
+	}, nil).Once()
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.InvalidArgument, "invalid argument")).Once()
+
+	sender := newTestGRPCLogSender(config, writer)
+	require.NoError(s.T(), sender.dispatcher.open())
+	events := newTestEvents(5, func(idx int) map[interface{}]interface{} {
+		record := map[interface{}]interface{}{"message": fmt.Sprintf("test_message_%d", idx)}
+		if idx == 0 {
+			record["unsupported"] = make(chan int)
+		}
+		return record
+	})
+
+	err := sender.Send(events)
+	assert.True(s.T(), errors.Is(err, ErrPermanent))
+	require.NoError(s.T(), sender.Close())
+
+	records := readDeadLetterFile(s.T(), config.DeadLetterPath)
+	require.Equal(s.T(), 4, len(records))
+	assert.Equal(s.T(), "test_message_0", records[0]["message"])
+	assert.True(s.T(), strings.HasPrefix(records[0]["reason"].(string), "conversion failed: "))
+	assert.Equal(s.T(), "test_message_3", records[1]["message"])
+	assert.Equal(s.T(), "test_message_4", records[2]["message"])
+	assert.True(s.T(), strings.HasPrefix(records[2]["reason"].(string), "request failed: "))
+	assert.Equal(s.T(), "test_message_2", records[3]["message"])
+	assert.Equal(s.T(), "rejected: code 3: entry is too large", records[3]["reason"])
+	for _, record := range records {
+		assert.Equal(s.T(), "test_tag", record["tag"])
+		assert.Equal(s.T(), config.LogGroupId, record["destination"].(map[string]interface{})["logGroupId"])
+	}
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_AsyncRetriesExhausted() {
+	config := s.config
+	// metrics are global, the instance id keeps them apart from other tests
+	config.PluginInstanceId = 26
+	config.FolderId = ""
+	config.MaxRequestEntries = 2
+	config.MaxRequestBytes = defaultMaxRequestBytes
+	config.DeadLetterPath = filepath.Join(s.T().TempDir(), "dead_letter.log")
+	config.DeadLetterMaxBytes = defaultDeadLetterMaxBytes
+	config.DeadLetterMaxFiles = defaultDeadLetterMaxFiles
+	config.Async = true
+	config.AsyncQueueSize = 10
+	config.AsyncWorkers = 1
+	config.AsyncBackpressure = AsyncBackpressureBlock
+
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.Unavailable, "unavailable"))
+
+	inner := newTestGRPCLogSender(config, writer)
+	require.NoError(s.T(), inner.dispatcher.open())
+	sender := NewAsyncLogSender(config, inner)
+	require.NoError(s.T(), sender.Send(newTestEvents(3, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": fmt.Sprintf("test_message_%d", idx)}
+	})))
+	require.NoError(s.T(), sender.Close())
+
+	writer.AssertNumberOfCalls(s.T(), "Write", 6)
+	assert.Equal(s.T(), float64(3), testutil.ToFloat64(entriesDroppedTotal.WithLabelValues("26", config.LogGroupId, dropReasonRetriesExhausted)),
+		"events fluent-bit considers delivered should be counted as dropped after retries")
+	records := readDeadLetterFile(s.T(), config.DeadLetterPath)
+	require.Equal(s.T(), 3, len(records))
+	for idx, record := range records {
+		assert.Equal(s.T(), fmt.Sprintf("test_message_%d", idx), record["message"])
+		assert.True(s.T(), strings.HasPrefix(record["reason"].(string), "request failed after retries: "))
+	}
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_Metrics() {
+	config := s.config
+	// metrics are global, the instance id keeps them apart from other tests
+	config.PluginInstanceId = 21
+	config.FolderId = ""
+	config.MaxRequestEntries = 2
+	config.MaxRequestBytes = defaultMaxRequestBytes
+
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.Unavailable, "unavailable")).Once()
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(&logging.WriteResponse{
+		Errors: map[int64]*status.Status{1: {Code: 3, Message: "entry is too large"}},
+	}, nil).Once()
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.InvalidArgument, "invalid argument")).Once()
+
+	sender := newTestGRPCLogSender(config, writer)
+	events := newTestEvents(5, func(idx int) map[interface{}]interface{} {
+		record := map[interface{}]interface{}{"message": fmt.Sprintf("test_message_%d", idx)}
+		if idx == 0 {
+			record["unsupported"] = make(chan int)
+		}
+		return record
+	})
+	assert.Error(s.T(), sender.Send(events))
+
+	instance, destination := "21", config.LogGroupId
+	assert.Equal(s.T(), float64(1), testutil.ToFloat64(conversionFailuresTotal.WithLabelValues(instance, destination)))
+	assert.Equal(s.T(), float64(1), testutil.ToFloat64(entriesSentTotal.WithLabelValues(instance, destination)))
+	assert.Equal(s.T(), float64(1), testutil.ToFloat64(entriesRejectedTotal.WithLabelValues(instance, destination)))
+	assert.Equal(s.T(), float64(2), testutil.ToFloat64(entriesDroppedTotal.WithLabelValues(instance, destination, dropReasonPermanentFailure)))
+	assert.Equal(s.T(), float64(1), testutil.ToFloat64(retriesTotal.WithLabelValues(instance, destination)))
+
+	var metric dto.Metric
+	histogram, err := requestDurationSeconds.GetMetricWithLabelValues(instance, destination)
+	require.NoError(s.T(), err)
+	require.NoError(s.T(), histogram.(prometheus.Metric).Write(&metric))
+	assert.Equal(s.T(), uint64(3), metric.GetHistogram().GetSampleCount(), "every attempt should be observed")
+}
+
+func (s *GRPCLogSenderTestSuite) TestGrpcLogSender_RateLimit() {
+	config := s.config
+	// metrics are global, the instance id keeps them apart from other tests
+	config.PluginInstanceId = 25
+	config.FolderId = ""
+	config.MaxRequestEntries = 10
+	config.MaxRequestBytes = defaultMaxRequestBytes
+	config.RateLimitEntries = 20
+	config.RateLimitAdaptive = true
+
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.ResourceExhausted, "quota exceeded")).Once()
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(&logging.WriteResponse{}, nil)
+
+	sender := newTestGRPCLogSender(config, writer)
+	events := newTestEvents(20, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": fmt.Sprintf("test_message_%d", idx)}
+	})
+
+	start := time.Now()
+	require.NoError(s.T(), sender.Send(events))
+	// the burst covers the failed attempt and its retry, the last batch waits for 10 entries at the halved rate
+	assert.GreaterOrEqual(s.T(), int64(time.Since(start)), int64(time.Millisecond*900))
+	assert.Equal(s.T(), 0.5, sender.dispatcher.limiter.Factor(), "rate should back off on exhausted quota")
+	writer.AssertNumberOfCalls(s.T(), "Write", 3)
+	assert.Greater(s.T(), testutil.ToFloat64(rateLimitWaitSeconds.WithLabelValues("25", config.LogGroupId)), 0.9)
+}
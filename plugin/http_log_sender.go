@@ -1,22 +1,34 @@
 package plugin
 
 import (
+	"context"
 	"crypto/rsa"
+	"encoding/json"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/json-iterator/go"
 	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
-	"io"
-	"io/ioutil"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	ycsdk "github.com/yandex-cloud/go-sdk"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"math"
+	"net"
 	"net/http"
-	"os"
 	"runtime"
+	"sync"
 	"time"
 	"yandex_logging/plugin/dto"
 )
 
+const (
+	// iamTokenAudience is the audience of JWT exchanged for IAM token
+	iamTokenAudience = "https://iam.api.cloud.yandex.net/iam/v1/tokens"
+	// maxJWTLifetime is the max lifetime of JWT accepted by IAM
+	maxJWTLifetime = time.Hour
+)
+
 var ps256WithSaltLengthEqualsHash = &jwt.SigningMethodRSAPSS{
 	SigningMethodRSA: jwt.SigningMethodPS256.SigningMethodRSA,
 	Options: &rsa.PSSOptions{
@@ -25,62 +37,120 @@ var ps256WithSaltLengthEqualsHash = &jwt.SigningMethodRSAPSS{
 }
 
 type yandexCloudHTTPClient struct {
-	requestTimeout   time.Duration
-	tokenLifetime    time.Duration
-	authToken        authToken
+	requestTimeout time.Duration
+	tokenLifetime  time.Duration
+	authToken      authToken
+	credentials    ycsdk.NonExchangeableCredentials
+	// tokenMu guards the token, which is used by concurrent senders and the spool replay
+	tokenMu          sync.Mutex
+	httpClient       *fasthttp.Client
 	doRequestHandler requestHandler
 	config           OutputPluginConfig
+	parentCtx        context.Context
+	cancelFn         context.CancelFunc
+	dispatcher       requestDispatcher
+	levels           levelMapper
+	messages         messageBuilder
 }
 
-func NewYandexCloudHTTPClient(config OutputPluginConfig) *yandexCloudHTTPClient {
+func NewYandexCloudHTTPClient(ctx context.Context, config OutputPluginConfig) (*yandexCloudHTTPClient, error) {
+	messages, err := newMessageBuilder(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancelFn := context.WithCancel(ctx)
 	cl := &yandexCloudHTTPClient{
 		config:         config,
-		requestTimeout: time.Second * 5,
-		tokenLifetime:  time.Minute * 5,
+		requestTimeout: config.requestTimeout(),
+		tokenLifetime:  config.tokenLifetime(),
+		httpClient:     newHTTPClient(config),
+		parentCtx:      ctx,
+		cancelFn:       cancelFn,
+		levels:         newLevelMapper(config.LevelMap),
+		messages:       messages,
+	}
+	cl.dispatcher = newRequestDispatcher(ctx, config, cl.requestTimeout, cl.write)
+	cl.dispatcher.entrySize = jsonEntrySize
+	cl.dispatcher.headerSize = jsonHeaderSize
+	if err := cl.dispatcher.open(); err != nil {
+		cancelFn()
+		return nil, err
 	}
 	cl.doRequestHandler = cl.doRequest
-	return cl
+	return cl, nil
 }
 
-func (y *yandexCloudHTTPClient) Send(events []*Event) error {
-
-	var entries []*dto.YCLogRecordEntry
-	for _, e := range events {
-		logKey := "LEVEL_UNSPECIFIED"
-
-		logKey, err := e.PopLogLevel(e.Record, y.config.LogLevelKey)
-		if err != nil {
-			log.Errorln(err)
+// newHTTPClient returns the client dialing with connect_timeout, fasthttp default is used if it is not set
+func newHTTPClient(config OutputPluginConfig) *fasthttp.Client {
+	client := &fasthttp.Client{}
+	if config.ConnectTimeout > 0 {
+		connectTimeout := config.ConnectTimeout
+		client.Dial = func(addr string) (net.Conn, error) {
+			return fasthttp.DialTimeout(addr, connectTimeout)
 		}
-
-		entries = append(entries, &dto.YCLogRecordEntry{
-			Timestamp:   e.Timestamp,
-			Level:       logKey,
-			JsonPayload: e.Record,
-		})
 	}
+	return client
+}
+
+// defaultHTTPClient is used by senders created without the client
+var defaultHTTPClient = &fasthttp.Client{}
 
-	reqModel := &dto.YCLogRecordRequestModel{
-		Destination: dto.YCLogRecordDestination{LogGroupID: y.config.LogGroupId, FolderId: y.config.FolderId},
-		Resource:    dto.YCLogRecordResource{ID: y.config.ResourceId, Type: y.config.ResourceType},
-		Entries:     entries,
+func (y *yandexCloudHTTPClient) client() *fasthttp.Client {
+	if y.httpClient == nil {
+		return defaultHTTPClient
 	}
-	if err := reqModel.Validate(); err != nil {
-		return err
+	return y.httpClient
+}
+
+// jsonEntrySize returns the size of the entry serialized into REST request body. The entry which can't be
+// serialized is larger than any limit, so it is sent alone and its failure doesn't affect other entries.
+func jsonEntrySize(entry *logging.IncomingLogEntry) int {
+	b, err := protojson.Marshal(entry)
+	if err != nil {
+		return math.MaxInt32
 	}
+	// entries are separated by comma
+	return len(b) + 1
+}
 
-	if err := y.doRequestHandler(reqModel); err != nil {
-		return err
+func jsonHeaderSize(wr *logging.WriteRequest) int {
+	b, err := protojson.Marshal(wr)
+	if err != nil {
+		return 0
 	}
+	return len(b) + len(`,"entries":[]`)
+}
 
-	return nil
+func (y *yandexCloudHTTPClient) Send(events []*Event) error {
+	reqModels := newRequestModels(y.config, y.levels, y.messages, events)
+	return y.dispatcher.sendRequestModels(reqModels, y.doRequestHandler)
 }
 
 func (y *yandexCloudHTTPClient) doRequest(reqModel *dto.YCLogRecordRequestModel) error {
-	var json = jsoniter.ConfigCompatibleWithStandardLibrary
-	b, err := json.Marshal(reqModel)
+	return y.dispatcher.dispatch(reqModel)
+}
+
+// Close cancels requests in progress and closes the spool and the dead letter file
+func (y *yandexCloudHTTPClient) Close() error {
+	if y.cancelFn != nil {
+		y.cancelFn()
+	}
+	return y.dispatcher.close()
+}
+
+// write sends the request to the REST write endpoint. Failures are returned as gRPC status errors,
+// so they are classified for retry the same way as for gRPC transport.
+func (y *yandexCloudHTTPClient) write(ctx context.Context, wr *logging.WriteRequest) (*logging.WriteResponse, error) {
+	b, err := protojson.Marshal(wr)
 	if err != nil {
-		return errors.Wrapf(err, "unable to marshal request model")
+		// the request is not going to be marshaled on retry either
+		return nil, status.Errorf(codes.InvalidArgument, "unable to marshal request model: %v", err)
+	}
+
+	token, err := y.getToken()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get iam token")
 	}
 
 	req := fasthttp.AcquireRequest()
@@ -89,31 +159,72 @@ func (y *yandexCloudHTTPClient) doRequest(reqModel *dto.YCLogRecordRequestModel)
 	req.Header.SetMethod(http.MethodPost)
 	req.Header.SetContentType("application/json")
 	req.Header.SetUserAgent(fmt.Sprintf("yandexcloud-fluent-bit-plugin (%s)", runtime.GOOS))
-
-	token, err := y.getToken()
-	if err != nil {
-		return err
-	}
-
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	req.SetBody(b)
 
-	//log.Debugln(req)
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(resp)
 
-	err = fasthttp.DoTimeout(req, resp, y.requestTimeout)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(y.requestTimeout)
+	}
+	err = y.client().DoDeadline(req, resp, deadline)
 	if err != nil {
-		return err
+		if errors.Is(err, fasthttp.ErrTimeout) {
+			return nil, status.Error(codes.DeadlineExceeded, err.Error())
+		}
+		return nil, status.Error(codes.Unavailable, err.Error())
 	}
 
 	if resp.StatusCode() != http.StatusOK {
-		return fmt.Errorf("an error occure while sending logs to yandex cloud: status_code: %d, body:%s", resp.StatusCode(), resp.Body())
+		return nil, httpStatusError(resp.StatusCode(), resp.Body())
+	}
+
+	response := &logging.WriteResponse{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(resp.Body(), response); err != nil {
+		return nil, errors.Wrapf(err, "unable to unmarshal write response")
+	}
+	return response, nil
+}
+
+// httpStatusError converts REST error response into gRPC status error. Yandex Cloud REST API returns gRPC
+// code in the body, HTTP status code is used if the body cannot be parsed.
+func httpStatusError(statusCode int, body []byte) error {
+	var errBody struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &errBody); err == nil && errBody.Code != 0 {
+		return status.Errorf(codes.Code(errBody.Code), "status_code: %d, %s", statusCode, errBody.Message)
+	}
+
+	code := codes.Unknown
+	switch statusCode {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	case http.StatusInternalServerError:
+		code = codes.Internal
 	}
-	return nil
+	return status.Errorf(code, "an error occure while sending logs to yandex cloud: status_code: %d, body:%s", statusCode, body)
 }
 
+// getToken returns IAM token, exchanging a new one if the current token is expired
 func (y *yandexCloudHTTPClient) getToken() (string, error) {
+	y.tokenMu.Lock()
+	defer y.tokenMu.Unlock()
 	if y.authToken.expiresAt.Before(time.Now()) {
 		authToken, err := y.createToken()
 		if err != nil {
@@ -124,49 +235,127 @@ func (y *yandexCloudHTTPClient) getToken() (string, error) {
 	return y.authToken.token, nil
 }
 
+// createToken gets a new IAM token according to auth_mode
 func (y *yandexCloudHTTPClient) createToken() (authToken, error) {
-
-	issuedAt := time.Now()
-	expiresAt := issuedAt.Add(y.tokenLifetime)
-	token := jwt.NewWithClaims(ps256WithSaltLengthEqualsHash, jwt.StandardClaims{
-		Issuer:    y.config.ServiceAccountID,
-		IssuedAt:  issuedAt.Unix(),
-		ExpiresAt: expiresAt.Unix(),
-		Audience:  "https://iam.api.cloud.yandex.net/iam/v1/tokens",
-	})
-	token.Header["kid"] = y.config.KeyID
-
-	f, err := os.OpenFile(y.config.PrivateKeyFilePath, os.O_RDONLY, os.ModePerm)
-	if err != nil {
-		return authToken{}, err
+	var token string
+	var tokenExpiresAt time.Time
+	var err error
+	switch y.config.AuthMode {
+	case "", AuthModeServiceAccountKey:
+		token, tokenExpiresAt, err = y.exchangeToken()
+	default:
+		token, tokenExpiresAt, err = y.requestToken()
 	}
-	defer f.Close()
-
-	privateKey, err := y.loadPrivateKey(f)
 	if err != nil {
 		return authToken{}, err
 	}
-	signed, err := token.SignedString(privateKey)
-	if err != nil {
-		return authToken{}, err
+
+	// token is refreshed at least every tokenLifetime to stay away from its expiration
+	expiresAt := time.Now().Add(y.tokenLifetime)
+	if !tokenExpiresAt.IsZero() && tokenExpiresAt.Before(expiresAt) {
+		expiresAt = tokenExpiresAt
 	}
 
 	y.authToken = authToken{
-		token:     signed,
+		token:     token,
 		expiresAt: expiresAt,
 	}
 	return y.authToken, nil
 }
 
-func (y *yandexCloudHTTPClient) loadPrivateKey(r io.Reader) (*rsa.PrivateKey, error) {
+// requestToken gets IAM token from the credentials which don't need exchange
+func (y *yandexCloudHTTPClient) requestToken() (string, time.Time, error) {
+	if y.credentials == nil {
+		credentials, err := newIAMTokenCredentials(y.config)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		y.credentials = credentials
+	}
 
-	data, err := ioutil.ReadAll(r)
+	ctx := y.parentCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancelFn := context.WithTimeout(ctx, y.requestTimeout)
+	defer cancelFn()
+	resp, err := y.credentials.IAMToken(ctx)
 	if err != nil {
-		return nil, err
+		return "", time.Time{}, err
+	}
+
+	var expiresAt time.Time
+	if resp.GetExpiresAt() != nil {
+		expiresAt = resp.GetExpiresAt().AsTime()
 	}
-	rsaPrivateKey, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+	return resp.GetIamToken(), expiresAt, nil
+}
+
+// exchangeToken exchanges self-signed JWT of the service account for IAM token
+func (y *yandexCloudHTTPClient) exchangeToken() (string, time.Time, error) {
+	signed, err := y.createJWT()
 	if err != nil {
-		return nil, err
+		return "", time.Time{}, err
+	}
+
+	b, err := json.Marshal(map[string]string{"jwt": signed})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI(y.config.IAMEndpointUrl)
+	req.Header.SetMethod(http.MethodPost)
+	req.Header.SetContentType("application/json")
+	req.Header.SetUserAgent(fmt.Sprintf("yandexcloud-fluent-bit-plugin (%s)", runtime.GOOS))
+	req.SetBody(b)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	err = y.client().DoTimeout(req, resp, y.requestTimeout)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("an error occure while creating iam token: status_code: %d, body:%s", resp.StatusCode(), resp.Body())
+	}
+
+	var tokenResponse struct {
+		IAMToken  string    `json:"iamToken"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	if err := json.Unmarshal(resp.Body(), &tokenResponse); err != nil {
+		return "", time.Time{}, errors.Wrapf(err, "unable to unmarshal iam token response")
+	}
+	return tokenResponse.IAMToken, tokenResponse.ExpiresAt, nil
+}
+
+// createJWT creates JWT signed with the service account key
+func (y *yandexCloudHTTPClient) createJWT() (string, error) {
+	key, err := loadServiceAccountKey(y.config)
+	if err != nil {
+		return "", err
+	}
+
+	lifetime := y.tokenLifetime
+	if lifetime > maxJWTLifetime {
+		lifetime = maxJWTLifetime
+	}
+	issuedAt := time.Now()
+	token := jwt.NewWithClaims(ps256WithSaltLengthEqualsHash, jwt.StandardClaims{
+		Issuer:    key.GetServiceAccountId(),
+		IssuedAt:  issuedAt.Unix(),
+		ExpiresAt: issuedAt.Add(lifetime).Unix(),
+		Audience:  iamTokenAudience,
+	})
+	token.Header["kid"] = key.GetId()
+
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(key.GetPrivateKey()))
+	if err != nil {
+		return "", err
 	}
-	return rsaPrivateKey, nil
+	return token.SignedString(privateKey)
 }
@@ -1,10 +1,23 @@
 package plugin
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
 	"time"
 	"yandex_logging/plugin/dto"
@@ -13,16 +26,70 @@ import (
 type HttpLogSenderTestSuite struct {
 	suite.Suite
 	config OutputPluginConfig
+	server *httptest.Server
+
+	mu            sync.Mutex
+	issuedTokens  int
+	writeBodies   []map[string]interface{}
+	writeAuth     []string
+	writeHandlers []http.HandlerFunc
 }
 
 func TestHttpLogSenderSuite(t *testing.T) {
 	suite.Run(t, new(HttpLogSenderTestSuite))
 }
 
-func (s *HttpLogSenderTestSuite) SetupSuite() {
+// SetupTest starts fake IAM and ingestion REST endpoints. Write responses are taken from writeHandlers
+// one by one, successful empty response is returned when they are over.
+func (s *HttpLogSenderTestSuite) SetupTest() {
+	s.issuedTokens = 0
+	s.writeBodies = nil
+	s.writeAuth = nil
+	s.writeHandlers = nil
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/iam/v1/tokens", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body["jwt"] == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.issuedTokens++
+		token := fmt.Sprintf("test_iam_token_%d", s.issuedTokens)
+		s.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"iamToken":  token,
+			"expiresAt": time.Now().Add(time.Hour * 12).Format(time.RFC3339Nano),
+		})
+	})
+	mux.HandleFunc("/logging/v1/write", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		var body map[string]interface{}
+		_ = json.Unmarshal(b, &body)
+
+		s.mu.Lock()
+		s.writeBodies = append(s.writeBodies, body)
+		s.writeAuth = append(s.writeAuth, r.Header.Get("Authorization"))
+		var handler http.HandlerFunc
+		if len(s.writeHandlers) > 0 {
+			handler, s.writeHandlers = s.writeHandlers[0], s.writeHandlers[1:]
+		}
+		s.mu.Unlock()
+
+		if handler != nil {
+			handler(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	})
+	s.server = httptest.NewServer(mux)
+
 	s.config = OutputPluginConfig{
 		PluginInstanceId:   0,
-		EndpointUrl:        "test_url",
+		Transport:          TransportHTTP,
+		EndpointUrl:        s.server.URL + "/logging/v1/write",
+		IAMEndpointUrl:     s.server.URL + "/iam/v1/tokens",
 		LogGroupId:         "test_log_group_id",
 		FolderId:           "test_folder_id",
 		ResourceId:         "test_resource_id",
@@ -31,9 +98,17 @@ func (s *HttpLogSenderTestSuite) SetupSuite() {
 		ServiceAccountID:   "test_service_account_id",
 		PrivateKeyFilePath: "testdata/test_private.pem",
 		LogLevelKey:        "log_level",
+		MessageKeys:        []string{"message"},
+		MaxRequestEntries:  defaultMaxRequestEntries,
+		MaxRequestBytes:    defaultMaxRequestBytes,
+		RetryMaxAttempts:   3,
 	}
 }
 
+func (s *HttpLogSenderTestSuite) TearDownTest() {
+	s.server.Close()
+}
+
 func (s *HttpLogSenderTestSuite) Test_PrivateKeyDoesntExist() {
 	s.config.PrivateKeyFilePath = "not_existed_test_private.pem"
 	client := &yandexCloudHTTPClient{config: s.config}
@@ -42,10 +117,42 @@ func (s *HttpLogSenderTestSuite) Test_PrivateKeyDoesntExist() {
 	assert.True(s.T(), errors.Is(err, os.ErrNotExist))
 }
 
+func (s *HttpLogSenderTestSuite) Test_GetTokenWithAuthorizedKeyFile() {
+	s.config.KeyID = ""
+	s.config.ServiceAccountID = ""
+	s.config.PrivateKeyFilePath = ""
+	s.config.AuthorizedKeyFilePath = "testdata/test_authorized_key.json"
+	client := &yandexCloudHTTPClient{
+		config:         s.config,
+		tokenLifetime:  time.Minute * 5,
+		requestTimeout: time.Second * 5,
+	}
+
+	token, err := client.getToken()
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), "test_iam_token_1", token)
+}
+
+func (s *HttpLogSenderTestSuite) Test_SendWithMetadataAuth() {
+	metadata := newFakeMetadataServer(s.T(), "test_metadata_token")
+	s.config.AuthMode = AuthModeMetadata
+	s.config.MetadataAddr = metadataAddr(s.T(), metadata)
+	client := s.newClient()
+
+	err := client.Send([]*Event{{
+		Timestamp: time.Now(),
+		Record:    map[interface{}]interface{}{"message": "test_message"},
+	}})
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), []string{"Bearer test_metadata_token"}, s.writeAuth)
+	assert.Equal(s.T(), 0, s.issuedTokens, "service account key should not be exchanged")
+}
+
 func (s *HttpLogSenderTestSuite) Test_GetTokenEqualsWithinExpiresTime() {
 	client := &yandexCloudHTTPClient{
-		config:        s.config,
-		tokenLifetime: time.Minute * 5,
+		config:         s.config,
+		tokenLifetime:  time.Minute * 5,
+		requestTimeout: time.Second * 5,
 	}
 
 	token, err := client.getToken()
@@ -59,8 +166,9 @@ func (s *HttpLogSenderTestSuite) Test_GetTokenEqualsWithinExpiresTime() {
 
 func (s *HttpLogSenderTestSuite) Test_GetTokenNotEqualsLifetimeOutOfDate() {
 	client := &yandexCloudHTTPClient{
-		config:        s.config,
-		tokenLifetime: time.Second * 1,
+		config:         s.config,
+		tokenLifetime:  time.Second * 1,
+		requestTimeout: time.Second * 5,
 	}
 
 	token, err := client.getToken()
@@ -74,7 +182,7 @@ func (s *HttpLogSenderTestSuite) Test_GetTokenNotEqualsLifetimeOutOfDate() {
 }
 
 func (s *HttpLogSenderTestSuite) Test_FindLogLevelValue() {
-	logLevelVal := "TEST_DEBUG"
+	logLevelVal := "DEBUG"
 	eventCount := 5
 	client := &yandexCloudHTTPClient{
 		config:         s.config,
@@ -104,3 +212,176 @@ func (s *HttpLogSenderTestSuite) Test_FindLogLevelValue() {
 	err := client.Send(events)
 	assert.NoError(s.T(), err)
 }
+
+func (s *HttpLogSenderTestSuite) newClient() *yandexCloudHTTPClient {
+	client, err := NewYandexCloudHTTPClient(context.Background(), s.config)
+	require.NoError(s.T(), err)
+	client.dispatcher.retryPolicy.baseDelay = 0
+	return client
+}
+
+func (s *HttpLogSenderTestSuite) Test_Send() {
+	ts := time.Date(2021, 8, 20, 10, 15, 30, 123456789, time.UTC)
+	client := s.newClient()
+
+	events := []*Event{{
+		Timestamp: ts,
+		Record: map[interface{}]interface{}{
+			s.config.LogLevelKey: "warning",
+			"message":            "test_message",
+			"key1":               []byte("value1"),
+			"nested":             map[interface{}]interface{}{"status": uint64(200)},
+		},
+	}}
+	err := client.Send(events)
+	require.NoError(s.T(), err)
+
+	require.Equal(s.T(), 1, len(s.writeBodies))
+	assert.Equal(s.T(), "Bearer test_iam_token_1", s.writeAuth[0])
+	assert.Equal(s.T(), map[string]interface{}{
+		"destination": map[string]interface{}{"folderId": "test_folder_id"},
+		"resource":    map[string]interface{}{"id": "test_resource_id", "type": "test_resource_type"},
+		"entries": []interface{}{map[string]interface{}{
+			"timestamp": "2021-08-20T10:15:30.123456789Z",
+			"level":     "WARN",
+			"message":   "test_message",
+			"jsonPayload": map[string]interface{}{
+				"key1":   "value1",
+				"nested": map[string]interface{}{"status": float64(200)},
+			},
+		}},
+	}, s.writeBodies[0])
+}
+
+func (s *HttpLogSenderTestSuite) Test_SendStreamName() {
+	s.config.StreamNameKey, _ = parseRecordAccessor("stream")
+	client := s.newClient()
+
+	events := newTestEvents(1, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message", "stream": "stderr"}
+	})
+	err := client.Send(events)
+	require.NoError(s.T(), err)
+
+	require.Equal(s.T(), 1, len(s.writeBodies))
+	entry := s.writeBodies[0]["entries"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(s.T(), "stderr", entry["streamName"])
+}
+
+func (s *HttpLogSenderTestSuite) Test_SendNonFiniteNumbers() {
+	client := s.newClient()
+
+	events := newTestEvents(1, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			"message": []byte("test_message\xff"),
+			"nan":     math.NaN(),
+			"inf":     math.Inf(1),
+			"ratio":   0.5,
+		}
+	})
+	err := client.Send(events)
+	require.NoError(s.T(), err)
+
+	require.Equal(s.T(), 1, len(s.writeBodies))
+	entry := s.writeBodies[0]["entries"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(s.T(), "test_message\uFFFD", entry["message"])
+	assert.Equal(s.T(), map[string]interface{}{"nan": "NaN", "inf": "Infinity", "ratio": 0.5}, entry["jsonPayload"])
+}
+
+func (s *HttpLogSenderTestSuite) Test_MarshalErrorIsPermanent() {
+	client := s.newClient()
+
+	wr := &logging.WriteRequest{Entries: []*logging.IncomingLogEntry{{
+		Message:     "test_message",
+		JsonPayload: &structpb.Struct{Fields: map[string]*structpb.Value{"nan": structpb.NewNumberValue(math.NaN())}},
+	}}}
+	_, err := client.write(context.Background(), wr)
+	assert.Equal(s.T(), codes.InvalidArgument, status.Code(err))
+	assert.True(s.T(), isPermanentError(err), "request which can't be marshaled should not be retried")
+	assert.Equal(s.T(), math.MaxInt32, jsonEntrySize(wr.Entries[0]), "entry which can't be marshaled should be sent alone")
+	assert.Equal(s.T(), 0, len(s.writeBodies))
+}
+
+func (s *HttpLogSenderTestSuite) Test_SplitIntoBatches() {
+	s.config.MaxRequestEntries = 2
+	client := s.newClient()
+
+	events := newTestEvents(5, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message"}
+	})
+	err := client.Send(events)
+	require.NoError(s.T(), err)
+
+	require.Equal(s.T(), 3, len(s.writeBodies))
+	assert.Equal(s.T(), 1, s.issuedTokens, "iam token should be reused")
+}
+
+func (s *HttpLogSenderTestSuite) Test_RejectedEntries() {
+	s.config.PartialFailurePolicy = PartialFailurePolicyRetry
+	s.writeHandlers = []http.HandlerFunc{func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"errors": {"1": {"code": 3, "message": "entry is too large"}}}`))
+	}}
+	client := s.newClient()
+	fallback := &recordingRejectedFallback{}
+	client.dispatcher.rejectedFallback = fallback
+
+	events := newTestEvents(2, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": fmt.Sprintf("test_message_%d", idx)}
+	})
+	err := client.Send(events)
+	assert.True(s.T(), errors.Is(err, ErrPartialFailure))
+	require.Equal(s.T(), 1, len(fallback.entries))
+	assert.Equal(s.T(), "test_message_1", fallback.entries[0].entry.Message)
+	assert.Equal(s.T(), "code 3: entry is too large", fallback.entries[0].reason)
+}
+
+func (s *HttpLogSenderTestSuite) Test_RetryTransientError() {
+	unavailable := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	s.writeHandlers = []http.HandlerFunc{unavailable, unavailable}
+	client := s.newClient()
+
+	events := newTestEvents(2, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message"}
+	})
+	err := client.Send(events)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 3, len(s.writeBodies))
+}
+
+func (s *HttpLogSenderTestSuite) Test_PermanentError() {
+	s.writeHandlers = []http.HandlerFunc{func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"code": 7, "message": "permission denied"}`))
+	}}
+	client := s.newClient()
+
+	events := newTestEvents(2, func(idx int) map[interface{}]interface{} {
+		return map[interface{}]interface{}{"message": "test_message"}
+	})
+	err := client.Send(events)
+	assert.True(s.T(), errors.Is(err, ErrPermanent))
+	assert.Equal(s.T(), 1, len(s.writeBodies))
+}
+
+func Test_HttpStatusError(t *testing.T) {
+	cases := []struct {
+		statusCode int
+		body       string
+		expected   codes.Code
+	}{
+		{http.StatusBadRequest, `{"code": 3, "message": "invalid argument"}`, codes.InvalidArgument},
+		{http.StatusServiceUnavailable, `{"code": 14, "message": "unavailable"}`, codes.Unavailable},
+		{http.StatusTooManyRequests, ``, codes.ResourceExhausted},
+		{http.StatusForbidden, `forbidden`, codes.PermissionDenied},
+		{http.StatusBadGateway, ``, codes.Unavailable},
+		{http.StatusGatewayTimeout, ``, codes.DeadlineExceeded},
+		{http.StatusTeapot, ``, codes.Unknown},
+	}
+
+	for _, c := range cases {
+		err := httpStatusError(c.statusCode, []byte(c.body))
+		assert.Equal(t, c.expected, status.Code(err), "status code %d", c.statusCode)
+	}
+}
@@ -1,6 +1,9 @@
 package plugin
 
 import (
+	"context"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	"google.golang.org/grpc"
 	"time"
 	"yandex_logging/plugin/dto"
 )
@@ -16,6 +19,9 @@ type LogSender interface {
 
 	// doRequest does request
 	doRequest(reqModel *dto.YCLogRecordRequestModel) error
+
+	// Close releases connections and cancels requests in progress
+	Close() error
 }
 
 // OutputPlugin is the interface for output plugin
@@ -26,8 +32,19 @@ type OutputPlugin interface {
 	// AddEvent adds new Event to the Event list
 	AddEvent(event *Event) int
 
+	// BeginChunk identifies the chunk of events added before the next flush
+	BeginChunk(tag string, data []byte)
+
 	// GetPluginInstanceID return ID of the plugin instance
 	GetPluginInstanceID() int
+
+	// Close flushes remaining events and closes the log sender
+	Close() error
+}
+
+// logIngestionWriter writes log entries to Yandex Cloud Logging ingestion service
+type logIngestionWriter interface {
+	Write(ctx context.Context, in *logging.WriteRequest, opts ...grpc.CallOption) (*logging.WriteResponse, error)
 }
 
 type requestHandler func(reqModel *dto.YCLogRecordRequestModel) error
@@ -0,0 +1,120 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	"strconv"
+	"strings"
+)
+
+// builtinLevelAliases maps commonly used level names to Yandex Cloud Logging levels
+var builtinLevelAliases = map[string]logging.LogLevel_Level{
+	"trace":         logging.LogLevel_TRACE,
+	"debug":         logging.LogLevel_DEBUG,
+	"dbg":           logging.LogLevel_DEBUG,
+	"info":          logging.LogLevel_INFO,
+	"information":   logging.LogLevel_INFO,
+	"informational": logging.LogLevel_INFO,
+	"notice":        logging.LogLevel_INFO,
+	"warn":          logging.LogLevel_WARN,
+	"warning":       logging.LogLevel_WARN,
+	"error":         logging.LogLevel_ERROR,
+	"err":           logging.LogLevel_ERROR,
+	"fatal":         logging.LogLevel_FATAL,
+	"crit":          logging.LogLevel_FATAL,
+	"critical":      logging.LogLevel_FATAL,
+	"alert":         logging.LogLevel_FATAL,
+	"emerg":         logging.LogLevel_FATAL,
+	"emergency":     logging.LogLevel_FATAL,
+	"panic":         logging.LogLevel_FATAL,
+}
+
+// syslogSeverities maps syslog severities 0-7 to Yandex Cloud Logging levels
+var syslogSeverities = []logging.LogLevel_Level{
+	logging.LogLevel_FATAL, // emergency
+	logging.LogLevel_FATAL, // alert
+	logging.LogLevel_FATAL, // critical
+	logging.LogLevel_ERROR, // error
+	logging.LogLevel_WARN,  // warning
+	logging.LogLevel_INFO,  // notice
+	logging.LogLevel_INFO,  // informational
+	logging.LogLevel_DEBUG, // debug
+}
+
+// levelMapper resolves record level values into Yandex Cloud Logging levels
+type levelMapper struct {
+	userLevels map[string]logging.LogLevel_Level
+}
+
+func newLevelMapper(userLevels map[string]logging.LogLevel_Level) levelMapper {
+	return levelMapper{userLevels: userLevels}
+}
+
+// Map resolves the level value. User defined mapping is checked first, then level names with
+// built-in aliases and then numeric levels: syslog severities 0-7 and bunyan/pino levels 10-60.
+func (m levelMapper) Map(value string) logging.LogLevel_Level {
+	key := strings.ToLower(strings.TrimSpace(value))
+	if level, ok := m.userLevels[key]; ok {
+		return level
+	}
+	if level, ok := parseLevelName(key); ok {
+		return level
+	}
+	if level, ok := builtinLevelAliases[key]; ok {
+		return level
+	}
+	if n, err := strconv.ParseFloat(key, 64); err == nil {
+		return numericLevel(n)
+	}
+	return logging.LogLevel_LEVEL_UNSPECIFIED
+}
+
+func numericLevel(n float64) logging.LogLevel_Level {
+	switch {
+	case n < 0:
+		return logging.LogLevel_LEVEL_UNSPECIFIED
+	case n < float64(len(syslogSeverities)):
+		return syslogSeverities[int(n)]
+	case n < 10:
+		return logging.LogLevel_LEVEL_UNSPECIFIED
+	case n < 20:
+		return logging.LogLevel_TRACE
+	case n < 30:
+		return logging.LogLevel_DEBUG
+	case n < 40:
+		return logging.LogLevel_INFO
+	case n < 50:
+		return logging.LogLevel_WARN
+	case n < 60:
+		return logging.LogLevel_ERROR
+	default:
+		return logging.LogLevel_FATAL
+	}
+}
+
+// parseLevelName parses Yandex Cloud Logging level name case-insensitively
+func parseLevelName(name string) (logging.LogLevel_Level, bool) {
+	level, ok := logging.LogLevel_Level_value[strings.ToUpper(name)]
+	return logging.LogLevel_Level(level), ok
+}
+
+// parseLevelMap parses level_map option value like `warn:WARN,crit:FATAL`
+func parseLevelMap(raw string) (map[string]logging.LogLevel_Level, error) {
+	levels := make(map[string]logging.LogLevel_Level)
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		idx := strings.LastIndex(item, ":")
+		if idx <= 0 {
+			return nil, errors.Wrapf(ErrInvalidValue, "level_map item `%s` must look like `value:LEVEL`", item)
+		}
+		level, ok := parseLevelName(strings.TrimSpace(item[idx+1:]))
+		if !ok {
+			return nil, errors.Wrapf(ErrInvalidValue, "level_map item `%s` has unknown level", item)
+		}
+		levels[strings.ToLower(strings.TrimSpace(item[:idx]))] = level
+	}
+	return levels, nil
+}
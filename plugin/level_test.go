@@ -0,0 +1,69 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	"testing"
+)
+
+func Test_LevelMapper_Map(t *testing.T) {
+	mapper := newLevelMapper(map[string]logging.LogLevel_Level{
+		"warn": logging.LogLevel_ERROR,
+		"35":   logging.LogLevel_WARN,
+	})
+
+	cases := []struct {
+		value    string
+		expected logging.LogLevel_Level
+	}{
+		{"DEBUG", logging.LogLevel_DEBUG},
+		{"fatal", logging.LogLevel_FATAL},
+		{"Info", logging.LogLevel_INFO},
+		{"notice", logging.LogLevel_INFO},
+		{"warning", logging.LogLevel_WARN},
+		{" err ", logging.LogLevel_ERROR},
+		{"CRIT", logging.LogLevel_FATAL},
+		{"LEVEL_UNSPECIFIED", logging.LogLevel_LEVEL_UNSPECIFIED},
+		{"0", logging.LogLevel_FATAL},
+		{"3", logging.LogLevel_ERROR},
+		{"4", logging.LogLevel_WARN},
+		{"6", logging.LogLevel_INFO},
+		{"7", logging.LogLevel_DEBUG},
+		{"10", logging.LogLevel_TRACE},
+		{"20", logging.LogLevel_DEBUG},
+		{"30", logging.LogLevel_INFO},
+		{"40", logging.LogLevel_WARN},
+		{"50", logging.LogLevel_ERROR},
+		{"60", logging.LogLevel_FATAL},
+		{"-1", logging.LogLevel_LEVEL_UNSPECIFIED},
+		{"something", logging.LogLevel_LEVEL_UNSPECIFIED},
+		// user defined mapping takes precedence over built-in one
+		{"WARN", logging.LogLevel_ERROR},
+		{"35", logging.LogLevel_WARN},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, mapper.Map(c.value), "level `%s`", c.value)
+	}
+}
+
+func Test_ParseLevelMap(t *testing.T) {
+	levels, err := parseLevelMap("warn:WARN, crit:fatal,Verbose:TRACE,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]logging.LogLevel_Level{
+		"warn":    logging.LogLevel_WARN,
+		"crit":    logging.LogLevel_FATAL,
+		"verbose": logging.LogLevel_TRACE,
+	}, levels)
+
+	levels, err = parseLevelMap("")
+	require.NoError(t, err)
+	assert.Empty(t, levels)
+
+	for _, raw := range []string{"warn", "warn:SEVERE", ":INFO"} {
+		_, err := parseLevelMap(raw)
+		assert.True(t, errors.Is(err, ErrInvalidValue), "should fail on `%s`", raw)
+	}
+}
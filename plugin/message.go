@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"text/template"
+	"text/template/parse"
+)
+
+// messageBuilder extracts entry message from the record either by the first found key of the
+// fallback list or by rendering the template with record fields
+type messageBuilder struct {
+	keys       []string
+	template   *template.Template
+	fields     []string
+	keepFields bool
+}
+
+func newMessageBuilder(config OutputPluginConfig) (messageBuilder, error) {
+	builder := messageBuilder{
+		keys:       config.MessageKeys,
+		keepFields: config.MessageKeepFields,
+	}
+	if config.MessageTemplate == "" {
+		return builder, nil
+	}
+
+	tmpl, err := template.New("message").Parse(config.MessageTemplate)
+	if err != nil {
+		return builder, errors.Wrapf(ErrInvalidValue, "message_template: %v", err)
+	}
+	builder.template = tmpl
+	builder.fields = templateFields(tmpl.Tree.Root)
+	return builder, nil
+}
+
+// Build returns the message of the record. Fields used for the message are removed from the record unless
+// they should be kept in payload.
+func (m messageBuilder) Build(e *Event) (string, error) {
+	if m.template != nil {
+		return m.render(e)
+	}
+
+	for _, messageKey := range m.keys {
+		key, val, ok := findRecordKey(e.Record, messageKey)
+		if !ok {
+			continue
+		}
+		var message string
+		switch t := val.(type) {
+		case string:
+			message = t
+		case []byte:
+			message = string(t)
+		default:
+			return "", fmt.Errorf("could not cast message key `%s` of type %T to string", messageKey, val)
+		}
+		if !m.keepFields {
+			delete(e.Record, key)
+		}
+		return message, nil
+	}
+
+	return "", fmt.Errorf("failed to find any of keys %v specified by message_key option in log record with keys %v", m.keys, recordKeys(e.Record))
+}
+
+func (m messageBuilder) render(e *Event) (string, error) {
+	data := make(map[string]interface{}, len(m.fields))
+	keys := make([]interface{}, 0, len(m.fields))
+	for _, field := range m.fields {
+		key, val, ok := findRecordKey(e.Record, field)
+		if !ok {
+			data[field] = ""
+			continue
+		}
+		if b, isBytes := val.([]byte); isBytes {
+			val = string(b)
+		}
+		data[field] = val
+		keys = append(keys, key)
+	}
+
+	var buf bytes.Buffer
+	if err := m.template.Execute(&buf, data); err != nil {
+		return "", errors.Wrapf(err, "could not render message_template")
+	}
+
+	if !m.keepFields {
+		for _, key := range keys {
+			delete(e.Record, key)
+		}
+	}
+	return buf.String(), nil
+}
+
+// templateFields returns names of top-level record fields referenced by the template like {{.method}}
+// or {{$.method}}
+func templateFields(node parse.Node) []string {
+	seen := make(map[string]bool)
+	var fields []string
+	addField := func(field string) {
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, cmd := range n.Cmds {
+				walk(cmd)
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.FieldNode:
+			addField(n.Ident[0])
+		case *parse.VariableNode:
+			// $ is the record itself, other variables hold values of fields referenced elsewhere
+			if n.Ident[0] == "$" && len(n.Ident) > 1 {
+				addField(n.Ident[1])
+			}
+		case *parse.ChainNode:
+			walk(n.Node)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		}
+	}
+	walk(node)
+	return fields
+}
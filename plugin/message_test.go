@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func Test_MessageBuilder_Keys(t *testing.T) {
+	builder, err := newMessageBuilder(OutputPluginConfig{MessageKeys: []string{"message", "msg", "log", "short_message"}})
+	require.NoError(t, err)
+
+	records := []map[interface{}]interface{}{
+		{"message": "from message", "msg": "from msg"},
+		{"msg": "from msg", "log": "from log"},
+		{"log": []byte("from log"), "stream": "stdout"},
+		{"short_message": "from short_message"},
+	}
+	expected := []string{"from message", "from msg", "from log", "from short_message"}
+
+	for idx, record := range records {
+		e := &Event{Timestamp: time.Now(), Record: record, Tag: "test_tag"}
+		message, err := builder.Build(e)
+		assert.NoError(t, err)
+		assert.Equal(t, expected[idx], message)
+	}
+
+	// only the key used for the message is removed
+	assert.Equal(t, map[interface{}]interface{}{"msg": "from msg"}, records[0])
+	assert.Equal(t, map[interface{}]interface{}{"stream": "stdout"}, records[2])
+}
+
+func Test_MessageBuilder_KeysAbsent(t *testing.T) {
+	builder, err := newMessageBuilder(OutputPluginConfig{MessageKeys: []string{"message", "msg"}})
+	require.NoError(t, err)
+
+	e := &Event{Timestamp: time.Now(), Record: map[interface{}]interface{}{"key1": "val1"}, Tag: "test_tag"}
+	_, err = builder.Build(e)
+	assert.Error(t, err)
+}
+
+func Test_MessageBuilder_KeepFields(t *testing.T) {
+	builder, err := newMessageBuilder(OutputPluginConfig{MessageKeys: []string{"msg"}, MessageKeepFields: true})
+	require.NoError(t, err)
+
+	record := map[interface{}]interface{}{"msg": "test_message"}
+	e := &Event{Timestamp: time.Now(), Record: record, Tag: "test_tag"}
+	message, err := builder.Build(e)
+	assert.NoError(t, err)
+	assert.Equal(t, "test_message", message)
+	assert.Equal(t, map[interface{}]interface{}{"msg": "test_message"}, record)
+}
+
+func Test_MessageBuilder_Template(t *testing.T) {
+	cases := []struct {
+		name       string
+		keepFields bool
+		record     map[interface{}]interface{}
+		message    string
+		payload    map[interface{}]interface{}
+	}{
+		{
+			name:    "all_fields",
+			record:  map[interface{}]interface{}{"method": "GET", "path": []byte("/index"), "status": uint64(200), "ip": "10.0.0.1"},
+			message: "GET /index 200",
+			payload: map[interface{}]interface{}{"ip": "10.0.0.1"},
+		},
+		{
+			name:       "keep_fields",
+			keepFields: true,
+			record:     map[interface{}]interface{}{"method": "GET", "path": "/index", "status": uint64(200)},
+			message:    "GET /index 200",
+			payload:    map[interface{}]interface{}{"method": "GET", "path": "/index", "status": uint64(200)},
+		},
+		{
+			name:    "missing_field",
+			record:  map[interface{}]interface{}{"method": "POST", "path": "/login"},
+			message: "POST /login ",
+			payload: map[interface{}]interface{}{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			builder, err := newMessageBuilder(OutputPluginConfig{
+				MessageTemplate:   "{{.method}} {{.path}} {{.status}}",
+				MessageKeepFields: c.keepFields,
+			})
+			require.NoError(t, err)
+
+			e := &Event{Timestamp: time.Now(), Record: c.record, Tag: "test_tag"}
+			message, err := builder.Build(e)
+			assert.NoError(t, err)
+			assert.Equal(t, c.message, message)
+			assert.Equal(t, c.payload, c.record)
+		})
+	}
+}
+
+func Test_MessageBuilder_InvalidTemplate(t *testing.T) {
+	_, err := newMessageBuilder(OutputPluginConfig{MessageTemplate: "{{.method"})
+	assert.True(t, errors.Is(err, ErrInvalidValue))
+}
+
+func Test_MessageBuilder_TemplateRootFields(t *testing.T) {
+	builder, err := newMessageBuilder(OutputPluginConfig{
+		MessageTemplate: "{{$.method}} {{with .request}}{{$.path}}{{end}} {{($.user).name}}",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"method", "request", "path", "user"}, builder.fields)
+
+	record := map[interface{}]interface{}{
+		"method":  "GET",
+		"request": "r-1",
+		"path":    "/index",
+		"user":    map[interface{}]interface{}{"name": "admin"},
+		"ip":      "10.0.0.1",
+	}
+	e := &Event{Timestamp: time.Now(), Record: record, Tag: "test_tag"}
+	message, err := builder.Build(e)
+	assert.NoError(t, err)
+	assert.Equal(t, "GET /index admin", message)
+	assert.Equal(t, map[interface{}]interface{}{"ip": "10.0.0.1"}, record)
+}
@@ -0,0 +1,211 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"yandex_logging/plugin/dto"
+)
+
+const metricsPath = "/metrics"
+
+// reason label values of yandexcloud_entries_dropped_total
+const (
+	// dropReasonInvalidRequest is the request which can't be sent, e.g. it fails validation
+	dropReasonInvalidRequest = "invalid_request"
+	// dropReasonPermanentFailure is the request failed with the error which is not retried
+	dropReasonPermanentFailure = "permanent_failure"
+	// dropReasonRetriesExhausted is the request still failed after retries which nobody is going to send again
+	dropReasonRetriesExhausted = "retries_exhausted"
+)
+
+// metricsRegistry holds metrics of all plugin instances, they are told apart by plugin_instance label
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	eventsReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yandexcloud_events_received_total",
+		Help: "Number of events received from fluent-bit.",
+	}, []string{"plugin_instance"})
+	entriesSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yandexcloud_entries_sent_total",
+		Help: "Number of entries accepted by Yandex Cloud Logging.",
+	}, []string{"plugin_instance", "destination"})
+	entriesRejectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yandexcloud_entries_rejected_total",
+		Help: "Number of entries rejected by Yandex Cloud Logging.",
+	}, []string{"plugin_instance", "destination"})
+	conversionFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yandexcloud_conversion_failures_total",
+		Help: "Number of entries dropped because the record could not be converted into the entry payload.",
+	}, []string{"plugin_instance", "destination"})
+	entriesDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yandexcloud_entries_dropped_total",
+		Help: "Number of entries dropped because of invalid request, permanent request failure or exhausted retries.",
+	}, []string{"plugin_instance", "destination", "reason"})
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yandexcloud_retries_total",
+		Help: "Number of retried write requests.",
+	}, []string{"plugin_instance", "destination"})
+	requestDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "yandexcloud_request_duration_seconds",
+		Help:    "Duration of write requests to Yandex Cloud Logging.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"plugin_instance", "destination"})
+	rateLimitWaitSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yandexcloud_rate_limit_wait_seconds_total",
+		Help: "Time write requests waited for the client-side rate limit.",
+	}, []string{"plugin_instance", "destination"})
+	spoolBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "yandexcloud_spool_bytes",
+		Help: "Size of the spool of failed batches waiting for replay.",
+	}, []string{"plugin_instance"})
+	queueEvents = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "yandexcloud_queue_events",
+		Help: "Number of events in the async queue.",
+	}, []string{"plugin_instance"})
+	queueDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "yandexcloud_queue_dropped_events_total",
+		Help: "Number of events dropped because the async queue is full.",
+	}, []string{"plugin_instance"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		eventsReceivedTotal,
+		entriesSentTotal,
+		entriesRejectedTotal,
+		conversionFailuresTotal,
+		entriesDroppedTotal,
+		retriesTotal,
+		requestDurationSeconds,
+		rateLimitWaitSeconds,
+		spoolBytes,
+		queueEvents,
+		queueDroppedTotal,
+	)
+}
+
+// pluginMetrics updates metrics of the plugin instance
+type pluginMetrics struct {
+	instance string
+}
+
+func newPluginMetrics(pluginInstanceID int) pluginMetrics {
+	return pluginMetrics{instance: strconv.Itoa(pluginInstanceID)}
+}
+
+// destinationLabel returns destination label value, which is the folder id or the log group id
+// the same way the destination of the write request is chosen
+func destinationLabel(destination dto.YCLogRecordDestination) string {
+	if destination.FolderId != "" {
+		return destination.FolderId
+	}
+	return destination.LogGroupID
+}
+
+func (m pluginMetrics) eventsReceived(count int) {
+	eventsReceivedTotal.WithLabelValues(m.instance).Add(float64(count))
+}
+
+func (m pluginMetrics) entriesSent(destination dto.YCLogRecordDestination, count int) {
+	entriesSentTotal.WithLabelValues(m.instance, destinationLabel(destination)).Add(float64(count))
+}
+
+func (m pluginMetrics) entriesRejected(destination dto.YCLogRecordDestination, count int) {
+	entriesRejectedTotal.WithLabelValues(m.instance, destinationLabel(destination)).Add(float64(count))
+}
+
+func (m pluginMetrics) conversionFailed(destination dto.YCLogRecordDestination) {
+	conversionFailuresTotal.WithLabelValues(m.instance, destinationLabel(destination)).Inc()
+}
+
+func (m pluginMetrics) entriesDropped(destination dto.YCLogRecordDestination, reason string, count int) {
+	entriesDroppedTotal.WithLabelValues(m.instance, destinationLabel(destination), reason).Add(float64(count))
+}
+
+func (m pluginMetrics) retried(destination dto.YCLogRecordDestination) {
+	retriesTotal.WithLabelValues(m.instance, destinationLabel(destination)).Inc()
+}
+
+func (m pluginMetrics) observeRequest(destination dto.YCLogRecordDestination, duration time.Duration) {
+	requestDurationSeconds.WithLabelValues(m.instance, destinationLabel(destination)).Observe(duration.Seconds())
+}
+
+func (m pluginMetrics) rateLimited(destination dto.YCLogRecordDestination, waited time.Duration) {
+	if waited <= 0 {
+		return
+	}
+	rateLimitWaitSeconds.WithLabelValues(m.instance, destinationLabel(destination)).Add(waited.Seconds())
+}
+
+func (m pluginMetrics) setSpoolSize(size int64) {
+	spoolBytes.WithLabelValues(m.instance).Set(float64(size))
+}
+
+func (m pluginMetrics) setQueueSize(size int) {
+	queueEvents.WithLabelValues(m.instance).Set(float64(size))
+}
+
+func (m pluginMetrics) queueDropped(count int) {
+	queueDroppedTotal.WithLabelValues(m.instance).Add(float64(count))
+}
+
+// metricsServer serves metricsRegistry, plugin instances with the same metrics_listen share it
+type metricsServer struct {
+	server *http.Server
+	refs   int
+}
+
+var (
+	metricsServersMu sync.Mutex
+	metricsServers   = make(map[string]*metricsServer)
+)
+
+// acquireMetricsServer starts the metrics server on the address unless it is already started by another instance
+func acquireMetricsServer(listen string) error {
+	metricsServersMu.Lock()
+	defer metricsServersMu.Unlock()
+
+	if s, ok := metricsServers[listen]; ok {
+		s.refs++
+		return nil
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return errors.Wrapf(err, "unable to start metrics server")
+	}
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	s := &metricsServer{server: &http.Server{Handler: mux}, refs: 1}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("metrics server on %s stopped: %v", listen, err)
+		}
+	}()
+	metricsServers[listen] = s
+	return nil
+}
+
+// releaseMetricsServer stops the metrics server on the address when the last instance using it releases it
+func releaseMetricsServer(listen string) error {
+	metricsServersMu.Lock()
+	defer metricsServersMu.Unlock()
+
+	s, ok := metricsServers[listen]
+	if !ok {
+		return nil
+	}
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(metricsServers, listen)
+	return s.server.Close()
+}
@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func Test_MetricsServer(t *testing.T) {
+	// the port is picked by the OS and released, so the server is able to listen on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listen := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	newPluginMetrics(1).eventsReceived(3)
+	require.NoError(t, acquireMetricsServer(listen))
+	require.NoError(t, acquireMetricsServer(listen), "instances with the same metrics_listen should share the server")
+
+	resp, err := http.Get("http://" + listen + metricsPath)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `yandexcloud_events_received_total{plugin_instance="1"}`)
+
+	require.NoError(t, releaseMetricsServer(listen))
+	_, err = http.Get("http://" + listen + metricsPath)
+	assert.NoError(t, err, "server should be kept while other instances use it")
+
+	require.NoError(t, releaseMetricsServer(listen))
+	_, err = http.Get("http://" + listen + metricsPath)
+	assert.Error(t, err, "server should be stopped when the last instance releases it")
+}
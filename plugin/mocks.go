@@ -1,7 +1,10 @@
 package plugin
 
 import (
+	"context"
 	"github.com/stretchr/testify/mock"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	"google.golang.org/grpc"
 	"yandex_logging/plugin/dto"
 )
 
@@ -21,11 +24,20 @@ func (m *MockOutputPlugin) AddEvent(event *Event) int {
 	return args.Get(0).(int)
 }
 
+func (m *MockOutputPlugin) BeginChunk(tag string, data []byte) {
+	m.Called(tag, data)
+}
+
 func (m *MockOutputPlugin) GetPluginInstanceID() int {
 	args := m.Called()
 	return args.Get(0).(int)
 }
 
+func (m *MockOutputPlugin) Close() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
 var _ LogSender = (*MockLogSender)(nil)
 
 type MockLogSender struct {
@@ -46,3 +58,20 @@ func (m *MockLogSender) doRequest(reqModel *dto.YCLogRecordRequestModel) error {
 	args := m.Called(reqModel)
 	return args.Error(0)
 }
+
+func (m *MockLogSender) Close() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+var _ logIngestionWriter = (*MockLogIngestionWriter)(nil)
+
+type MockLogIngestionWriter struct {
+	mock.Mock
+}
+
+func (m *MockLogIngestionWriter) Write(ctx context.Context, in *logging.WriteRequest, opts ...grpc.CallOption) (*logging.WriteResponse, error) {
+	args := m.Called(in)
+	response, _ := args.Get(0).(*logging.WriteResponse)
+	return response, args.Error(1)
+}
@@ -1,29 +1,257 @@
 package plugin
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	fluentbit "github.com/fluent/fluent-bit-go/output"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+	"yandex_logging/plugin/dto"
+)
+
+var ErrShutdownTimeout = errors.New("Shutdown timeout exceeded")
+
+const (
+	// maxBatchSendAttempts is the number of failed sends after which events kept in the batch are dropped
+	maxBatchSendAttempts = 5
+	// maxTrackedChunks is the number of failed chunks whose done events are remembered until fluent-bit retries them
+	maxTrackedChunks = 1024
 )
 
 type ycOutputPlugin struct {
 	pluginInstanceID int
 	logSender        LogSender
 	events           []*Event
+	shutdownTimeout  time.Duration
+	closeOnce        sync.Once
+	closeErr         error
+
+	// chunk identifies the current chunk of events. Done events of failed chunks are kept in doneEvents
+	// until fluent-bit retries them, doneChunks holds the order chunks failed in
+	chunk      string
+	doneEvents map[string][]bool
+	doneChunks []string
+
+	batchMaxEntries int
+	batchMaxBytes   int
+	batchMaxWait    time.Duration
+	// batchMu guards the batch, which is also sent by the batch timer
+	batchMu      sync.Mutex
+	batch        []*Event
+	batchBytes   int
+	batchStarted time.Time
+	// batchFailures is the number of failed sends of events kept in the batch
+	batchFailures int
+	stopTimer     chan struct{}
+	timerDone     chan struct{}
+
+	// router and defaultDestination resolve destinations of dropped events for metrics
+	router             destinationRouter
+	defaultDestination dto.YCLogRecordDestination
+	metrics            pluginMetrics
 }
 
 func NewYandexCloudOutputPlugin(config OutputPluginConfig, logSender LogSender) *ycOutputPlugin {
-	return &ycOutputPlugin{
-		pluginInstanceID: config.PluginInstanceId,
-		logSender:        logSender,
+	p := &ycOutputPlugin{
+		pluginInstanceID:   config.PluginInstanceId,
+		logSender:          logSender,
+		doneEvents:         make(map[string][]bool),
+		shutdownTimeout:    config.ShutdownTimeout,
+		batchMaxEntries:    config.BatchMaxEntries,
+		batchMaxBytes:      config.BatchMaxBytes,
+		batchMaxWait:       config.BatchMaxWait,
+		router:             newDestinationRouter(config),
+		defaultDestination: dto.YCLogRecordDestination{LogGroupID: config.LogGroupId, FolderId: config.FolderId},
+		metrics:            newPluginMetrics(config.PluginInstanceId),
+	}
+	if p.batchMaxWait > 0 {
+		p.stopTimer = make(chan struct{})
+		p.timerDone = make(chan struct{})
+		go p.runBatchTimer()
 	}
+	return p
 }
 
+// Flush sends events added since the previous flush. Events are dropped from the buffer even if sending
+// fails: fluent-bit retries the failed chunk as a whole, so keeping them would send them twice.
+// Events of the failed chunk which are already done are skipped when fluent-bit retries it.
+// If batching is enabled, events are added to the batch, which is sent when one of its limits is reached.
 func (p *ycOutputPlugin) Flush() error {
-	err := p.logSender.Send(p.events)
-	if err != nil {
+	events := p.events
+	chunk := p.chunk
+	p.events, p.chunk = nil, ""
+	// events of the chunk retried by fluent-bit are counted when it is flushed for the first time
+	if _, retried := p.doneEvents[chunk]; !retried {
+		p.metrics.eventsReceived(len(events))
+	}
+	p.restoreDoneEvents(chunk, events)
+	if !p.batching() {
+		err := p.logSender.Send(events)
+		p.trackChunk(chunk, events, err)
 		return err
 	}
-	p.events = nil
-	return nil
+
+	p.batchMu.Lock()
+	defer p.batchMu.Unlock()
+	if len(p.batch) == 0 {
+		p.batchStarted = time.Now()
+	}
+	acknowledged := len(p.batch)
+	for _, e := range events {
+		p.batch = append(p.batch, e)
+		p.batchBytes += estimateRecordSize(e.Record)
+	}
+	if !p.batchFull() {
+		p.trackChunk(chunk, events, nil)
+		return nil
+	}
+	err := p.sendBatch(acknowledged)
+	p.trackChunk(chunk, events, err)
+	return err
+}
+
+// BeginChunk identifies events added before the next flush by the tag and the data of the chunk,
+// so the chunk is recognized when fluent-bit retries it
+func (p *ycOutputPlugin) BeginChunk(tag string, data []byte) {
+	h := sha256.New()
+	h.Write([]byte(tag))
+	h.Write([]byte{0})
+	h.Write(data)
+	p.chunk = hex.EncodeToString(h.Sum(nil))
+}
+
+// restoreDoneEvents marks events of the retried chunk which were done before it failed
+func (p *ycOutputPlugin) restoreDoneEvents(chunk string, events []*Event) {
+	done, ok := p.doneEvents[chunk]
+	if !ok || len(done) != len(events) {
+		return
+	}
+	for idx, e := range events {
+		e.done = done[idx]
+	}
+}
+
+// trackChunk remembers done events of the chunk failed with transient error until fluent-bit retries it.
+// The oldest chunks are forgotten after maxTrackedChunks, since fluent-bit may give up retrying them.
+func (p *ycOutputPlugin) trackChunk(chunk string, events []*Event, err error) {
+	if chunk == "" {
+		return
+	}
+	if err == nil || errors.Is(err, ErrPermanent) {
+		if _, ok := p.doneEvents[chunk]; ok {
+			delete(p.doneEvents, chunk)
+			p.forgetChunk(chunk)
+		}
+		return
+	}
+	done := make([]bool, len(events))
+	for idx, e := range events {
+		done[idx] = e.done
+	}
+	if _, ok := p.doneEvents[chunk]; !ok {
+		if len(p.doneChunks) >= maxTrackedChunks {
+			delete(p.doneEvents, p.doneChunks[0])
+			p.doneChunks = p.doneChunks[1:]
+		}
+		p.doneChunks = append(p.doneChunks, chunk)
+	}
+	p.doneEvents[chunk] = done
+}
+
+func (p *ycOutputPlugin) forgetChunk(chunk string) {
+	for idx, c := range p.doneChunks {
+		if c == chunk {
+			p.doneChunks = append(p.doneChunks[:idx], p.doneChunks[idx+1:]...)
+			return
+		}
+	}
+}
+
+// batching returns true if events are kept across flushes
+func (p *ycOutputPlugin) batching() bool {
+	return p.batchMaxEntries > 0 || p.batchMaxBytes > 0 || p.batchMaxWait > 0
+}
+
+func (p *ycOutputPlugin) batchFull() bool {
+	return (p.batchMaxEntries > 0 && len(p.batch) >= p.batchMaxEntries) ||
+		(p.batchMaxBytes > 0 && p.batchBytes >= p.batchMaxBytes) ||
+		(p.batchMaxWait > 0 && time.Since(p.batchStarted) >= p.batchMaxWait)
+}
+
+// sendBatch sends the batch, the first acknowledged events of it belong to chunks fluent-bit considers delivered.
+// If sending fails with transient error, they are kept to be sent with the next batch after batch_max_wait,
+// while the rest of events is dropped, since fluent-bit retries the current chunk. Kept events are dropped
+// after maxBatchSendAttempts failed sends. batchMu must be held.
+func (p *ycOutputPlugin) sendBatch(acknowledged int) error {
+	err := p.logSender.Send(p.batch)
+	if err != nil && !errors.Is(err, ErrPermanent) && acknowledged > 0 {
+		p.batchFailures++
+		if p.batchFailures < maxBatchSendAttempts {
+			p.batch = p.batch[:acknowledged:acknowledged]
+			p.batchBytes = 0
+			for _, e := range p.batch {
+				p.batchBytes += estimateRecordSize(e.Record)
+			}
+			p.batchStarted = time.Now()
+			return err
+		}
+		p.dropEvents(p.batch[:acknowledged], err)
+	}
+	p.batch = nil
+	p.batchBytes = 0
+	p.batchFailures = 0
+	return err
+}
+
+// dropEvents reports events of delivered chunks dropped after failed sends of the batch, done events are not dropped
+func (p *ycOutputPlugin) dropEvents(events []*Event, err error) {
+	dropped := make(map[dto.YCLogRecordDestination]int)
+	count := 0
+	for _, e := range events {
+		if e.done {
+			continue
+		}
+		count++
+		destination, ok := p.router.Route(e)
+		if !ok {
+			destination = p.defaultDestination
+		}
+		dropped[destination]++
+	}
+	log.Errorf("[yandexcloud %d] %d events kept in the batch are dropped after %d failed sends: %v",
+		p.pluginInstanceID, count, p.batchFailures, err)
+	for destination, count := range dropped {
+		p.metrics.entriesDropped(destination, dropReasonRetriesExhausted, count)
+	}
+}
+
+// runBatchTimer sends the batch when it waits for batch_max_wait, so events are not held while there are no flushes
+func (p *ycOutputPlugin) runBatchTimer() {
+	defer close(p.timerDone)
+	interval := p.batchMaxWait / 4
+	if interval < time.Millisecond*10 {
+		interval = time.Millisecond * 10
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopTimer:
+			return
+		case <-ticker.C:
+		}
+
+		p.batchMu.Lock()
+		if len(p.batch) > 0 && time.Since(p.batchStarted) >= p.batchMaxWait {
+			count := len(p.batch)
+			if err := p.sendBatch(count); err != nil {
+				log.Errorf("[yandexcloud %d] batch of %d events failed: %v", p.pluginInstanceID, count, err)
+			}
+		}
+		p.batchMu.Unlock()
+	}
 }
 
 func (p *ycOutputPlugin) AddEvent(event *Event) int {
@@ -34,3 +262,48 @@ func (p *ycOutputPlugin) AddEvent(event *Event) int {
 func (p *ycOutputPlugin) GetPluginInstanceID() int {
 	return p.pluginInstanceID
 }
+
+// Close sends remaining events and closes the log sender. It gives up after the shutdown timeout,
+// repeated calls return the result of the first one.
+func (p *ycOutputPlugin) Close() error {
+	p.closeOnce.Do(func() {
+		done := make(chan error, 1)
+		go func() {
+			done <- p.drain()
+		}()
+
+		if p.shutdownTimeout <= 0 {
+			p.closeErr = <-done
+			return
+		}
+		timer := time.NewTimer(p.shutdownTimeout)
+		defer timer.Stop()
+		select {
+		case p.closeErr = <-done:
+		case <-timer.C:
+			p.closeErr = errors.Wrapf(ErrShutdownTimeout, "plugin instance %d", p.pluginInstanceID)
+		}
+	})
+	return p.closeErr
+}
+
+func (p *ycOutputPlugin) drain() error {
+	if p.stopTimer != nil {
+		close(p.stopTimer)
+		<-p.timerDone
+	}
+
+	var flushErr error
+	p.batchMu.Lock()
+	p.metrics.eventsReceived(len(p.events))
+	events := append(p.batch, p.events...)
+	p.batch, p.events = nil, nil
+	p.batchMu.Unlock()
+	if len(events) > 0 {
+		flushErr = p.logSender.Send(events)
+	}
+	if err := p.logSender.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
@@ -2,8 +2,16 @@ package plugin
 
 import (
 	"fmt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"strings"
 	"testing"
 	"time"
 )
@@ -47,7 +55,35 @@ func Test_OutputPlugin_Flush_With_Error(t *testing.T) {
 	assert.Equal(t, 5, len(plugin.events), "There are must be 5 event inside")
 	err := plugin.Flush()
 	assert.Error(t, err, "err should not be nil in this place")
-	assert.Equal(t, 5, len(plugin.events), "There are must be 5 event inside")
+	assert.Equal(t, 0, len(plugin.events), "There are must be 0 event inside")
+}
+
+func Test_OutputPlugin_Retry_After_Failed_Flush(t *testing.T) {
+	mockLogSender := &MockLogSender{}
+	var sentCounts []int
+	mockLogSender.On("Send", mock.AnythingOfType("[]*plugin.Event")).Run(func(args mock.Arguments) {
+		sentCounts = append(sentCounts, len(args.Get(0).([]*Event)))
+	}).Return(fmt.Errorf("some send error")).Once()
+	mockLogSender.On("Send", mock.AnythingOfType("[]*plugin.Event")).Run(func(args mock.Arguments) {
+		sentCounts = append(sentCounts, len(args.Get(0).([]*Event)))
+	}).Return(nil).Once()
+	plugin := NewYandexCloudOutputPlugin(OutputPluginConfig{}, mockLogSender)
+
+	// fluent-bit calls flush with the same chunk again after the failed one
+	eventsQuantity := 5
+	for attempt := 0; attempt < 2; attempt++ {
+		for i := 0; i < eventsQuantity; i++ {
+			plugin.AddEvent(&Event{
+				Timestamp: time.Now(),
+				Record:    map[interface{}]interface{}{"key1": "val1", "key2": "val2"},
+				Tag:       "test_tag",
+			})
+		}
+		_ = plugin.Flush()
+	}
+
+	assert.Equal(t, []int{eventsQuantity, eventsQuantity}, sentCounts, "retried chunk must be sent without duplicates")
+	assert.Equal(t, 0, len(plugin.events), "There are must be 0 event inside")
 }
 
 func Test_OutputPlugin_Different_Events_Slices(t *testing.T) {
@@ -82,3 +118,288 @@ func Test_OutputPlugin_Different_Events_Slices(t *testing.T) {
 	assert.NotEqual(t, firstElemSliceP, secondElemSliceP, "slice elems addresses should not be equal")
 	assert.Equal(t, 5, len(plugin.events), "There are must be 5 event inside")
 }
+
+func Test_OutputPlugin_Close(t *testing.T) {
+	mockLogSender := &MockLogSender{}
+	mockLogSender.On("Send", mock.AnythingOfType("[]*plugin.Event")).Return(nil).Once()
+	mockLogSender.On("Close").Return(nil).Once()
+	plugin := NewYandexCloudOutputPlugin(OutputPluginConfig{ShutdownTimeout: time.Second}, mockLogSender)
+
+	plugin.AddEvent(&Event{
+		Timestamp: time.Now(),
+		Record:    map[interface{}]interface{}{"key1": "val1"},
+		Tag:       "test_tag",
+	})
+
+	assert.NoError(t, plugin.Close())
+	assert.NoError(t, plugin.Close(), "repeated close should return result of the first one")
+	assert.Equal(t, 0, len(plugin.events), "There are must be 0 event inside")
+	mockLogSender.AssertNumberOfCalls(t, "Send", 1)
+	mockLogSender.AssertNumberOfCalls(t, "Close", 1)
+}
+
+func Test_OutputPlugin_Close_Without_Events(t *testing.T) {
+	mockLogSender := &MockLogSender{}
+	mockLogSender.On("Close").Return(nil).Once()
+	plugin := NewYandexCloudOutputPlugin(OutputPluginConfig{ShutdownTimeout: time.Second}, mockLogSender)
+
+	assert.NoError(t, plugin.Close())
+	mockLogSender.AssertNotCalled(t, "Send", mock.Anything)
+}
+
+func Test_OutputPlugin_Close_Timeout(t *testing.T) {
+	mockLogSender := &MockLogSender{}
+	mockLogSender.On("Send", mock.AnythingOfType("[]*plugin.Event")).After(time.Second).Return(nil)
+	mockLogSender.On("Close").Return(nil)
+	plugin := NewYandexCloudOutputPlugin(OutputPluginConfig{ShutdownTimeout: time.Millisecond * 50}, mockLogSender)
+
+	plugin.AddEvent(&Event{
+		Timestamp: time.Now(),
+		Record:    map[interface{}]interface{}{"key1": "val1"},
+		Tag:       "test_tag",
+	})
+
+	err := plugin.Close()
+	assert.True(t, errors.Is(err, ErrShutdownTimeout))
+}
+
+func flushTestEvents(plugin *ycOutputPlugin, count int) error {
+	for i := 0; i < count; i++ {
+		plugin.AddEvent(&Event{
+			Timestamp: time.Now(),
+			Record:    map[interface{}]interface{}{"key1": fmt.Sprintf("val%d", i)},
+			Tag:       "test_tag",
+		})
+	}
+	return plugin.Flush()
+}
+
+func Test_OutputPlugin_Batch_MaxEntries(t *testing.T) {
+	mockLogSender := &MockLogSender{}
+	var sentCounts []int
+	mockLogSender.On("Send", mock.AnythingOfType("[]*plugin.Event")).Run(func(args mock.Arguments) {
+		sentCounts = append(sentCounts, len(args.Get(0).([]*Event)))
+	}).Return(nil)
+	mockLogSender.On("Close").Return(nil)
+	plugin := NewYandexCloudOutputPlugin(OutputPluginConfig{BatchMaxEntries: 5, BatchMaxWait: time.Hour}, mockLogSender)
+
+	assert.NoError(t, flushTestEvents(plugin, 3))
+	mockLogSender.AssertNotCalled(t, "Send", mock.Anything)
+	assert.NoError(t, flushTestEvents(plugin, 3))
+	assert.NoError(t, flushTestEvents(plugin, 2))
+	assert.Equal(t, []int{6}, sentCounts, "events of several flushes should be sent in one batch")
+
+	assert.NoError(t, plugin.Close())
+	assert.Equal(t, []int{6, 2}, sentCounts, "remaining events should be sent on close")
+}
+
+func Test_OutputPlugin_Batch_MaxBytes(t *testing.T) {
+	mockLogSender := &MockLogSender{}
+	mockLogSender.On("Send", mock.AnythingOfType("[]*plugin.Event")).Return(nil)
+	plugin := NewYandexCloudOutputPlugin(OutputPluginConfig{BatchMaxBytes: 40, BatchMaxWait: time.Hour}, mockLogSender)
+	defer close(plugin.stopTimer)
+
+	// every event takes 8 bytes
+	assert.NoError(t, flushTestEvents(plugin, 4))
+	mockLogSender.AssertNotCalled(t, "Send", mock.Anything)
+	assert.NoError(t, flushTestEvents(plugin, 1))
+	mockLogSender.AssertNumberOfCalls(t, "Send", 1)
+}
+
+func Test_OutputPlugin_Batch_MaxWait(t *testing.T) {
+	mockLogSender := &MockLogSender{}
+	mockLogSender.On("Send", mock.AnythingOfType("[]*plugin.Event")).Return(nil)
+	plugin := NewYandexCloudOutputPlugin(OutputPluginConfig{BatchMaxWait: time.Millisecond * 50}, mockLogSender)
+	defer close(plugin.stopTimer)
+
+	assert.NoError(t, flushTestEvents(plugin, 2))
+	assert.Eventually(t, func() bool {
+		plugin.batchMu.Lock()
+		defer plugin.batchMu.Unlock()
+		return len(plugin.batch) == 0
+	}, time.Second, time.Millisecond*10, "batch should be sent without further flushes")
+	mockLogSender.AssertNumberOfCalls(t, "Send", 1)
+}
+
+func Test_OutputPlugin_Batch_Failure(t *testing.T) {
+	mockLogSender := &MockLogSender{}
+	var sentCounts []int
+	mockLogSender.On("Send", mock.AnythingOfType("[]*plugin.Event")).Run(func(args mock.Arguments) {
+		sentCounts = append(sentCounts, len(args.Get(0).([]*Event)))
+	}).Return(fmt.Errorf("some send error")).Once()
+	mockLogSender.On("Send", mock.AnythingOfType("[]*plugin.Event")).Run(func(args mock.Arguments) {
+		sentCounts = append(sentCounts, len(args.Get(0).([]*Event)))
+	}).Return(nil)
+	plugin := NewYandexCloudOutputPlugin(OutputPluginConfig{BatchMaxEntries: 5, BatchMaxWait: time.Hour}, mockLogSender)
+	defer close(plugin.stopTimer)
+
+	assert.NoError(t, flushTestEvents(plugin, 3))
+	assert.Error(t, flushTestEvents(plugin, 3), "chunk which completed the failed batch should be retried")
+	// fluent-bit retries the failed chunk, events of the delivered one are kept in the batch
+	assert.NoError(t, flushTestEvents(plugin, 3))
+	assert.Equal(t, []int{6, 6}, sentCounts)
+}
+
+func Test_OutputPlugin_Batch_ResendKeptEvents(t *testing.T) {
+	config := OutputPluginConfig{
+		LogGroupId:      "test_log_group_id",
+		LogLevelKey:     "log_level",
+		TimeKey:         "time",
+		TimeFormat:      TimeFormatUnix,
+		BatchMaxEntries: 2,
+		BatchMaxWait:    time.Hour,
+	}
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.Internal, "internal")).Once()
+	var entries []*logging.IncomingLogEntry
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(func(args mock.Arguments) {
+		entries = append(entries, args.Get(0).(*logging.WriteRequest).Entries...)
+	}).Return(&logging.WriteResponse{}, nil)
+	plugin := NewYandexCloudOutputPlugin(config, newTestGRPCLogSender(config, writer))
+	defer close(plugin.stopTimer)
+
+	flush := func(message string) error {
+		plugin.AddEvent(&Event{
+			Timestamp: time.Now(),
+			Record:    map[interface{}]interface{}{"message": message, "log_level": "ERROR", "time": int64(1600000000)},
+			Tag:       "test_tag",
+		})
+		return plugin.Flush()
+	}
+	require.NoError(t, flush("m1"))
+	require.Error(t, flush("m2"), "chunk which completed the failed batch should be retried")
+	require.NoError(t, flush("m2"))
+
+	require.Equal(t, 2, len(entries))
+	for idx, message := range []string{"m1", "m2"} {
+		assert.Equal(t, message, entries[idx].Message)
+		assert.Equal(t, logging.LogLevel_ERROR, entries[idx].Level, "kept event should be converted again the same way")
+		assert.Equal(t, int64(1600000000), entries[idx].Timestamp.GetSeconds())
+	}
+}
+
+func Test_OutputPlugin_Batch_KeptEventsDropped(t *testing.T) {
+	// metrics are global, the instance id keeps them apart from other tests
+	config := OutputPluginConfig{PluginInstanceId: 23, LogGroupId: "test_log_group_id", BatchMaxWait: time.Millisecond * 30}
+	mockLogSender := &MockLogSender{}
+	mockLogSender.On("Send", mock.AnythingOfType("[]*plugin.Event")).Return(fmt.Errorf("some send error"))
+	plugin := NewYandexCloudOutputPlugin(config, mockLogSender)
+	defer close(plugin.stopTimer)
+
+	start := time.Now()
+	assert.NoError(t, flushTestEvents(plugin, 2))
+	assert.Eventually(t, func() bool {
+		plugin.batchMu.Lock()
+		defer plugin.batchMu.Unlock()
+		return len(plugin.batch) == 0
+	}, time.Second*2, time.Millisecond*10, "kept events should be dropped after failed sends")
+
+	mockLogSender.AssertNumberOfCalls(t, "Send", maxBatchSendAttempts)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(config.BatchMaxWait*maxBatchSendAttempts),
+		"failed batch should be sent again after batch_max_wait")
+	assert.Equal(t, float64(2), testutil.ToFloat64(entriesDroppedTotal.WithLabelValues("23", config.LogGroupId, dropReasonRetriesExhausted)))
+}
+
+func newTestChunkPlugin(config OutputPluginConfig, writer logIngestionWriter) *ycOutputPlugin {
+	config.LogGroupId = "test_log_group_id"
+	config.MaxRequestBytes = defaultMaxRequestBytes
+	return NewYandexCloudOutputPlugin(config, newTestGRPCLogSender(config, writer))
+}
+
+// flushTestChunk flushes the chunk of messages the way fluent-bit does, so the retried chunk is recognized
+func flushTestChunk(plugin *ycOutputPlugin, messages ...string) error {
+	plugin.BeginChunk("test_tag", []byte(strings.Join(messages, ",")))
+	for _, message := range messages {
+		plugin.AddEvent(&Event{
+			Timestamp: time.Unix(1600000000, 0),
+			Record:    map[interface{}]interface{}{"message": message},
+			Tag:       "test_tag",
+		})
+	}
+	return plugin.Flush()
+}
+
+func writtenMessages(entries *[]string) func(args mock.Arguments) {
+	return func(args mock.Arguments) {
+		for _, entry := range args.Get(0).(*logging.WriteRequest).Entries {
+			*entries = append(*entries, entry.Message)
+		}
+	}
+}
+
+func Test_OutputPlugin_Retry_After_Partial_Failure(t *testing.T) {
+	writer := &MockLogIngestionWriter{}
+	var messages []string
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(writtenMessages(&messages)).
+		Return(&logging.WriteResponse{}, nil).Once()
+	// the second request fails after all retries of the sender
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.Unavailable, "unavailable")).Times(3)
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(writtenMessages(&messages)).
+		Return(&logging.WriteResponse{}, nil)
+	plugin := newTestChunkPlugin(OutputPluginConfig{MaxRequestEntries: 2}, writer)
+
+	err := flushTestChunk(plugin, "m0", "m1", "m2", "m3")
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, ErrPermanent), "chunk should be retried by fluent-bit")
+	require.NoError(t, flushTestChunk(plugin, "m0", "m1", "m2", "m3"))
+
+	assert.Equal(t, []string{"m0", "m1", "m2", "m3"}, messages, "written entries should not be sent again")
+	assert.Equal(t, 0, len(plugin.doneEvents), "delivered chunk should be forgotten")
+}
+
+func Test_OutputPlugin_Retry_Rejected_Entries(t *testing.T) {
+	writer := &MockLogIngestionWriter{}
+	var messages []string
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(writtenMessages(&messages)).
+		Return(&logging.WriteResponse{
+			Errors: map[int64]*status.Status{1: {Code: 14, Message: "try again later"}},
+		}, nil).Once()
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(writtenMessages(&messages)).
+		Return(&logging.WriteResponse{}, nil)
+	plugin := newTestChunkPlugin(OutputPluginConfig{PartialFailurePolicy: PartialFailurePolicyRetry}, writer)
+
+	err := flushTestChunk(plugin, "m0", "m1", "m2")
+	require.True(t, errors.Is(err, ErrPartialFailure))
+	require.NoError(t, flushTestChunk(plugin, "m0", "m1", "m2"))
+
+	assert.Equal(t, []string{"m0", "m1", "m2", "m1"}, messages, "only the rejected entry should be sent again")
+}
+
+func Test_OutputPlugin_Batch_Resend_After_Partial_Failure(t *testing.T) {
+	writer := &MockLogIngestionWriter{}
+	var messages []string
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(writtenMessages(&messages)).
+		Return(&logging.WriteResponse{}, nil).Once()
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.Unavailable, "unavailable")).Times(3)
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Run(writtenMessages(&messages)).
+		Return(&logging.WriteResponse{}, nil)
+	plugin := newTestChunkPlugin(OutputPluginConfig{MaxRequestEntries: 1, BatchMaxEntries: 2, BatchMaxWait: time.Hour}, writer)
+	defer close(plugin.stopTimer)
+
+	require.NoError(t, flushTestChunk(plugin, "m1"))
+	require.Error(t, flushTestChunk(plugin, "m2"), "chunk which completed the failed batch should be retried")
+	// m1 is kept in the batch after it is written, it is not sent with the retried chunk
+	require.NoError(t, flushTestChunk(plugin, "m2"))
+
+	assert.Equal(t, []string{"m1", "m2"}, messages)
+}
+
+func Test_OutputPlugin_Events_Received_Once(t *testing.T) {
+	writer := &MockLogIngestionWriter{}
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).
+		Return(nil, grpcstatus.Error(codes.Unavailable, "unavailable")).Times(3)
+	writer.On("Write", mock.AnythingOfType("*logging.WriteRequest")).Return(&logging.WriteResponse{}, nil)
+	// metrics are global, the instance id keeps them apart from other tests
+	plugin := newTestChunkPlugin(OutputPluginConfig{PluginInstanceId: 24}, writer)
+
+	require.Error(t, flushTestChunk(plugin, "m0", "m1"))
+	require.NoError(t, flushTestChunk(plugin, "m0", "m1"))
+	require.NoError(t, flushTestChunk(plugin, "m2"))
+
+	writer.AssertNumberOfCalls(t, "Write", 5)
+	assert.Equal(t, float64(3), testutil.ToFloat64(eventsReceivedTotal.WithLabelValues("24")),
+		"events of the retried chunk should be counted once")
+}
@@ -0,0 +1,46 @@
+package plugin
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// buildPayload returns json payload of the entry made of the remaining record fields. The payload is taken from
+// payload_key sub-map if it is set, then include_keys and exclude_keys are applied to it.
+func buildPayload(config OutputPluginConfig, record map[interface{}]interface{}) map[interface{}]interface{} {
+	payload := record
+	if config.PayloadKey.IsSet() {
+		val, ok := config.PayloadKey.Get(record)
+		if subRecord, isMap := val.(map[interface{}]interface{}); ok && isMap {
+			payload = subRecord
+		} else {
+			log.Debugf("[yandexcloud %d] payload_key `%s` is not found or is not a map, the whole record is sent",
+				config.PluginInstanceId, config.PayloadKey)
+		}
+	}
+
+	if len(config.IncludeKeys) > 0 {
+		included := make(map[interface{}]interface{}, len(config.IncludeKeys))
+		for _, key := range config.IncludeKeys {
+			key.CopyTo(payload, included)
+		}
+		payload = included
+	}
+
+	for _, key := range config.ExcludeKeys {
+		key.Delete(payload)
+	}
+	return payload
+}
+
+// parseRecordAccessorList parses the comma separated list of record keys
+func parseRecordAccessorList(getConfigKey configKeyGetter, key string) ([]recordAccessor, error) {
+	var accessors []recordAccessor
+	for _, item := range parseListConfigKey(getConfigKey, key) {
+		accessor, err := parseRecordAccessor(item)
+		if err != nil {
+			return nil, err
+		}
+		accessors = append(accessors, accessor)
+	}
+	return accessors, nil
+}
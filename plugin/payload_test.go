@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func newTestPayloadRecord() map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		"method": "GET",
+		"http": map[interface{}]interface{}{
+			"status": int64(200),
+			"body":   "raw body",
+			"headers": map[interface{}]interface{}{
+				"user_agent": "curl",
+				"cookie":     "secret",
+			},
+		},
+		"kubernetes": map[interface{}]interface{}{
+			"pod_name":  "app-5d9f",
+			"namespace": "prod",
+		},
+	}
+}
+
+func Test_BuildPayload(t *testing.T) {
+	parseKeys := func(keys ...string) []recordAccessor {
+		var accessors []recordAccessor
+		for _, key := range keys {
+			accessor, err := parseRecordAccessor(key)
+			require.NoError(t, err)
+			accessors = append(accessors, accessor)
+		}
+		return accessors
+	}
+
+	t.Run("whole_record", func(t *testing.T) {
+		assert.Equal(t, newTestPayloadRecord(), buildPayload(OutputPluginConfig{}, newTestPayloadRecord()))
+	})
+
+	t.Run("exclude_keys", func(t *testing.T) {
+		config := OutputPluginConfig{ExcludeKeys: parseKeys("http.body", "$http['headers']['cookie']", "missing.key")}
+		payload := buildPayload(config, newTestPayloadRecord())
+		assert.Equal(t, map[interface{}]interface{}{
+			"status":  int64(200),
+			"headers": map[interface{}]interface{}{"user_agent": "curl"},
+		}, payload["http"])
+	})
+
+	t.Run("include_keys", func(t *testing.T) {
+		config := OutputPluginConfig{
+			IncludeKeys: parseKeys("method", "http.status", "http.headers", "missing.key"),
+			ExcludeKeys: parseKeys("http.headers.cookie"),
+		}
+		payload := buildPayload(config, newTestPayloadRecord())
+		assert.Equal(t, map[interface{}]interface{}{
+			"method": "GET",
+			"http": map[interface{}]interface{}{
+				"status":  int64(200),
+				"headers": map[interface{}]interface{}{"user_agent": "curl"},
+			},
+		}, payload)
+	})
+
+	t.Run("payload_key", func(t *testing.T) {
+		config := OutputPluginConfig{ExcludeKeys: parseKeys("body")}
+		config.PayloadKey, _ = parseRecordAccessor("http")
+		payload := buildPayload(config, newTestPayloadRecord())
+		assert.Equal(t, map[interface{}]interface{}{
+			"status":  int64(200),
+			"headers": map[interface{}]interface{}{"user_agent": "curl", "cookie": "secret"},
+		}, payload)
+
+		config.PayloadKey, _ = parseRecordAccessor("method")
+		assert.Equal(t, newTestPayloadRecord()["method"], buildPayload(config, newTestPayloadRecord())["method"],
+			"the whole record should be sent if payload_key is not a map")
+	})
+}
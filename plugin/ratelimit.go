@@ -0,0 +1,149 @@
+package plugin
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// adaptiveMinFactor is the lowest share of the configured rate the adaptive limiter backs off to
+	adaptiveMinFactor = 1.0 / 64
+	// adaptiveBackoff is the share of the current rate kept after the server reports exhausted quota
+	adaptiveBackoff = 0.5
+	// adaptiveRecovery is the growth of the current rate after adaptiveRecoveryInterval without exhausted quota
+	adaptiveRecovery = 1.25
+	// adaptiveRecoveryInterval is the interval between rate changes before the rate is recovered
+	adaptiveRecoveryInterval = time.Second * 10
+	// adaptiveBackoffInterval is the interval between rate decreases, so parallel requests failed
+	// by the same burst back off the rate once
+	adaptiveBackoffInterval = time.Second
+)
+
+// tokenBucket holds tokens of a single limit. The bucket holds up to a second of tokens and the balance can go
+// below zero, so requests larger than the bucket are sent after the debt is refilled instead of being blocked forever.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) tokenBucket {
+	return tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// reserve takes n tokens at the rate reduced by factor and returns the time to wait for them
+func (b *tokenBucket) reserve(now time.Time, n int, factor float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	rate := b.rate * factor
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(rate, b.tokens+elapsed.Seconds()*rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// rateLimiter limits entries and bytes written per second by the plugin instance. With rate_limit_adaptive
+// the rate is halved when Cloud Logging reports exhausted quota and is recovered gradually afterwards.
+type rateLimiter struct {
+	mu       sync.Mutex
+	entries  tokenBucket
+	bytes    tokenBucket
+	adaptive bool
+	// factor is the share of the configured rate currently allowed
+	factor     float64
+	lastAdjust time.Time
+	now        func() time.Time
+}
+
+// newRateLimiter returns nil if neither rate_limit_entries nor rate_limit_bytes is set
+func newRateLimiter(config OutputPluginConfig) *rateLimiter {
+	if config.RateLimitEntries <= 0 && config.RateLimitBytes <= 0 {
+		return nil
+	}
+	now := time.Now()
+	return &rateLimiter{
+		entries:  newTokenBucket(config.RateLimitEntries, now),
+		bytes:    newTokenBucket(config.RateLimitBytes, now),
+		adaptive: config.RateLimitAdaptive,
+		factor:   1,
+		now:      time.Now,
+	}
+}
+
+// reserve takes tokens for the request and returns the time to wait before sending it
+func (l *rateLimiter) reserve(entries, bytes int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	entriesDelay := l.entries.reserve(now, entries, l.factor)
+	bytesDelay := l.bytes.reserve(now, bytes, l.factor)
+	if entriesDelay > bytesDelay {
+		return entriesDelay
+	}
+	return bytesDelay
+}
+
+// Wait blocks until the request of the given number of entries and bytes is allowed or ctx is done.
+// Wait is no-op for nil limiter, so callers don't check if the rate limit is set.
+func (l *rateLimiter) Wait(ctx context.Context, entries, bytes int) (time.Duration, error) {
+	if l == nil {
+		return 0, nil
+	}
+	delay := l.reserve(entries, bytes)
+	if delay <= 0 {
+		return 0, nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return delay, nil
+	case <-ctx.Done():
+		return delay, errors.Wrapf(ctx.Err(), "rate limit wait of %s interrupted", delay)
+	}
+}
+
+// Observe adapts the rate to the result of the write request if rate_limit_adaptive is set.
+// It returns true if the rate is changed.
+func (l *rateLimiter) Observe(err error) bool {
+	if l == nil || !l.adaptive {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if status.Code(errors.Cause(err)) == codes.ResourceExhausted {
+		if l.factor <= adaptiveMinFactor || now.Sub(l.lastAdjust) < adaptiveBackoffInterval {
+			return false
+		}
+		l.factor = math.Max(adaptiveMinFactor, l.factor*adaptiveBackoff)
+		l.lastAdjust = now
+		return true
+	}
+	if err != nil || l.factor >= 1 || now.Sub(l.lastAdjust) < adaptiveRecoveryInterval {
+		return false
+	}
+	l.factor = math.Min(1, l.factor*adaptiveRecovery)
+	l.lastAdjust = now
+	return true
+}
+
+// Factor returns the share of the configured rate currently allowed
+func (l *rateLimiter) Factor() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.factor
+}
@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+// newTestRateLimiter returns the limiter with the clock controlled by the test
+func newTestRateLimiter(config OutputPluginConfig, now *time.Time) *rateLimiter {
+	limiter := newRateLimiter(config)
+	limiter.now = func() time.Time { return *now }
+	limiter.entries.last = *now
+	limiter.bytes.last = *now
+	return limiter
+}
+
+func Test_RateLimiter_Reserve(t *testing.T) {
+	now := time.Now()
+	limiter := newTestRateLimiter(OutputPluginConfig{RateLimitEntries: 100, RateLimitBytes: 1000}, &now)
+
+	assert.Zero(t, limiter.reserve(50, 100), "request within the burst should not wait")
+	assert.Zero(t, limiter.reserve(50, 100))
+	assert.Equal(t, time.Millisecond*500, limiter.reserve(50, 100), "entries over the burst should wait for refill")
+
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Second, limiter.reserve(100, 2000), "bytes limit should be applied with entries limit")
+
+	now = now.Add(time.Second * 10)
+	assert.Zero(t, limiter.reserve(100, 1000), "bucket should not hold more than a second of tokens")
+	assert.Equal(t, time.Millisecond*10, limiter.reserve(1, 0))
+}
+
+func Test_RateLimiter_Wait(t *testing.T) {
+	assert.Nil(t, newRateLimiter(OutputPluginConfig{}), "limiter should not be created without limits")
+	var limiter *rateLimiter
+	waited, err := limiter.Wait(context.Background(), 1000, 1000)
+	assert.NoError(t, err)
+	assert.Zero(t, waited)
+
+	limiter = newRateLimiter(OutputPluginConfig{RateLimitEntries: 10})
+	_, err = limiter.Wait(context.Background(), 10, 0)
+	require.NoError(t, err)
+	waited, err = limiter.Wait(context.Background(), 1, 0)
+	require.NoError(t, err)
+	assert.InDelta(t, float64(time.Millisecond*100), float64(waited), float64(time.Millisecond*10))
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	cancelFn()
+	_, err = limiter.Wait(ctx, 100, 0)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func Test_RateLimiter_Adaptive(t *testing.T) {
+	now := time.Now()
+	limiter := newTestRateLimiter(OutputPluginConfig{RateLimitEntries: 100, RateLimitAdaptive: true}, &now)
+	exhausted := status.Error(codes.ResourceExhausted, "quota exceeded")
+
+	assert.False(t, limiter.Observe(nil), "full rate should not be recovered")
+	assert.True(t, limiter.Observe(errors.Wrap(exhausted, "batch failed")))
+	assert.Equal(t, 0.5, limiter.Factor())
+	assert.False(t, limiter.Observe(exhausted), "the same burst should back off once")
+	assert.False(t, limiter.Observe(status.Error(codes.Unavailable, "unavailable")))
+
+	now = now.Add(adaptiveBackoffInterval)
+	assert.True(t, limiter.Observe(exhausted))
+	assert.Equal(t, 0.25, limiter.Factor())
+	assert.Zero(t, limiter.reserve(25, 0))
+	assert.Equal(t, time.Second, limiter.reserve(25, 0), "reduced rate should be applied")
+
+	assert.False(t, limiter.Observe(nil), "rate should not be recovered right after back off")
+	now = now.Add(adaptiveRecoveryInterval)
+	assert.True(t, limiter.Observe(nil))
+	assert.Equal(t, 0.25*adaptiveRecovery, limiter.Factor())
+	for i := 0; i < 10; i++ {
+		now = now.Add(adaptiveRecoveryInterval)
+		limiter.Observe(nil)
+	}
+	assert.Equal(t, 1.0, limiter.Factor(), "rate should not exceed the configured one")
+
+	for i := 0; i < 10; i++ {
+		now = now.Add(adaptiveBackoffInterval)
+		limiter.Observe(exhausted)
+	}
+	assert.Equal(t, adaptiveMinFactor, limiter.Factor())
+
+	static := newTestRateLimiter(OutputPluginConfig{RateLimitEntries: 100}, &now)
+	assert.False(t, static.Observe(exhausted), "rate should not be adapted without rate_limit_adaptive")
+}
@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+// recordAccessor reads a value out of nested record maps. The path is given either with fluent-bit record
+// accessor syntax like `$kubernetes['namespace_name']` or with dots like `kubernetes.namespace_name`.
+type recordAccessor struct {
+	path []string
+}
+
+func parseRecordAccessor(raw string) (recordAccessor, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return recordAccessor{}, nil
+	}
+	if !strings.HasPrefix(raw, "$") {
+		path := strings.Split(raw, ".")
+		for _, key := range path {
+			if key == "" {
+				return recordAccessor{}, errors.Wrapf(ErrInvalidValue, "record key `%s` has an empty path item", raw)
+			}
+		}
+		return recordAccessor{path: path}, nil
+	}
+
+	rest := raw[1:]
+	idx := strings.Index(rest, "[")
+	if idx < 0 {
+		idx = len(rest)
+	}
+	path := []string{rest[:idx]}
+	rest = rest[idx:]
+	for rest != "" {
+		end := strings.Index(rest, "]")
+		if !strings.HasPrefix(rest, "[") || end < 0 {
+			return recordAccessor{}, errors.Wrapf(ErrInvalidValue, "record accessor `%s` must look like `$key['subkey']`", raw)
+		}
+		key := strings.Trim(rest[1:end], `'"`)
+		path = append(path, key)
+		rest = rest[end+1:]
+	}
+	for _, key := range path {
+		if key == "" {
+			return recordAccessor{}, errors.Wrapf(ErrInvalidValue, "record accessor `%s` has an empty key", raw)
+		}
+	}
+	return recordAccessor{path: path}, nil
+}
+
+// IsSet returns true if the accessor has a path to read
+func (a recordAccessor) IsSet() bool {
+	return len(a.path) > 0
+}
+
+// Get returns the value found by the path
+func (a recordAccessor) Get(record map[interface{}]interface{}) (interface{}, bool) {
+	if !a.IsSet() {
+		return nil, false
+	}
+	current := record
+	for idx, key := range a.path {
+		_, val, ok := findRecordKey(current, key)
+		if !ok {
+			return nil, false
+		}
+		if idx == len(a.path)-1 {
+			return val, true
+		}
+		if current, ok = val.(map[interface{}]interface{}); !ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// Delete removes the value found by the path from the record
+func (a recordAccessor) Delete(record map[interface{}]interface{}) {
+	if !a.IsSet() {
+		return
+	}
+	current := record
+	for idx, key := range a.path {
+		recordKey, val, ok := findRecordKey(current, key)
+		if !ok {
+			return
+		}
+		if idx == len(a.path)-1 {
+			delete(current, recordKey)
+			return
+		}
+		if current, ok = val.(map[interface{}]interface{}); !ok {
+			return
+		}
+	}
+}
+
+// CopyTo copies the value found by the path from the record into dst keeping its nesting
+func (a recordAccessor) CopyTo(record, dst map[interface{}]interface{}) {
+	if _, ok := a.Get(record); !ok {
+		return
+	}
+	current := record
+	for idx, key := range a.path {
+		recordKey, val, ok := findRecordKey(current, key)
+		if !ok {
+			return
+		}
+		if idx == len(a.path)-1 {
+			dst[recordKey] = val
+			return
+		}
+		if current, ok = val.(map[interface{}]interface{}); !ok {
+			return
+		}
+		next, ok := dst[recordKey].(map[interface{}]interface{})
+		if !ok {
+			next = make(map[interface{}]interface{})
+			dst[recordKey] = next
+		}
+		dst = next
+	}
+}
+
+// GetString returns the value found by the path converted into non-empty string
+func (a recordAccessor) GetString(record map[interface{}]interface{}) (string, bool) {
+	val, ok := a.Get(record)
+	if !ok {
+		return "", false
+	}
+	var s string
+	switch t := val.(type) {
+	case string:
+		s = t
+	case []byte:
+		s = string(t)
+	case int64:
+		s = strconv.FormatInt(t, 10)
+	case uint64:
+		s = strconv.FormatUint(t, 10)
+	default:
+		return "", false
+	}
+	return s, s != ""
+}
+
+func (a recordAccessor) String() string {
+	return strings.Join(a.path, ".")
+}
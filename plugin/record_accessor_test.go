@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_ParseRecordAccessor(t *testing.T) {
+	cases := []struct {
+		raw  string
+		path []string
+	}{
+		{raw: "", path: nil},
+		{raw: "namespace", path: []string{"namespace"}},
+		{raw: "kubernetes.namespace_name", path: []string{"kubernetes", "namespace_name"}},
+		{raw: "$namespace", path: []string{"namespace"}},
+		{raw: "$kubernetes['namespace_name']", path: []string{"kubernetes", "namespace_name"}},
+		{raw: `$kubernetes["labels"]['app.kubernetes.io/name']`, path: []string{"kubernetes", "labels", "app.kubernetes.io/name"}},
+	}
+	for _, c := range cases {
+		accessor, err := parseRecordAccessor(c.raw)
+		require.NoError(t, err, c.raw)
+		assert.Equal(t, c.path, accessor.path, c.raw)
+	}
+
+	for _, raw := range []string{"kubernetes..name", "$kubernetes['name'", "$kubernetes[]", "$kubernetes['a']b"} {
+		_, err := parseRecordAccessor(raw)
+		assert.True(t, errors.Is(err, ErrInvalidValue), "should fail on `%s`", raw)
+	}
+}
+
+func Test_RecordAccessor_Get(t *testing.T) {
+	record := map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{
+			"namespace_name": []byte("prod"),
+			"pod_id":         int64(42),
+		},
+		"flat": "value",
+	}
+
+	accessor, _ := parseRecordAccessor("$kubernetes['namespace_name']")
+	value, ok := accessor.GetString(record)
+	assert.True(t, ok)
+	assert.Equal(t, "prod", value)
+
+	accessor, _ = parseRecordAccessor("kubernetes.pod_id")
+	value, ok = accessor.GetString(record)
+	assert.True(t, ok)
+	assert.Equal(t, "42", value)
+
+	for _, raw := range []string{"kubernetes.missing", "flat.nested", "kubernetes", "missing"} {
+		accessor, _ = parseRecordAccessor(raw)
+		_, ok = accessor.GetString(record)
+		assert.False(t, ok, raw)
+	}
+
+	_, ok = recordAccessor{}.Get(record)
+	assert.False(t, ok, "empty accessor should not find anything")
+}
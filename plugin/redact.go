@@ -0,0 +1,216 @@
+package plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// RedactModeMask replaces sensitive data with redact_mask
+	RedactModeMask = "mask"
+	// RedactModeHash replaces sensitive data with salted hash, so equal values stay correlated
+	RedactModeHash = "hash"
+
+	defaultRedactMask = "[REDACTED]"
+	// redactHashLength is the number of hex characters of the hash kept in the replacement
+	redactHashLength = 16
+)
+
+// builtinRedactPatterns are value patterns which are enabled by name in redact_values option
+var builtinRedactPatterns = map[string]*regexp.Regexp{
+	"card_number": regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+	"jwt":         regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	"email":       regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+}
+
+// redactor masks sensitive data in the entry message and payload. Values of keys matching key patterns are
+// replaced as a whole, parts of string values matching value patterns are replaced anywhere in the record.
+// Numbers matching value patterns, like card numbers stored as integers, are replaced with strings.
+type redactor struct {
+	keys   []*regexp.Regexp
+	values []*regexp.Regexp
+	mode   string
+	mask   string
+	salt   []byte
+}
+
+func newRedactor(config OutputPluginConfig) redactor {
+	mask := config.RedactMask
+	if mask == "" {
+		mask = defaultRedactMask
+	}
+	return redactor{
+		keys:   config.RedactKeys,
+		values: config.RedactValues,
+		mode:   config.RedactMode,
+		mask:   mask,
+		salt:   []byte(config.RedactHashSalt),
+	}
+}
+
+// enabled returns true if there is anything to redact
+func (r redactor) enabled() bool {
+	return len(r.keys) > 0 || len(r.values) > 0
+}
+
+// RedactMessage replaces sensitive parts of the message
+func (r redactor) RedactMessage(message string) string {
+	for _, pattern := range r.values {
+		message = pattern.ReplaceAllStringFunc(message, r.replace)
+	}
+	return message
+}
+
+// RedactPayload replaces sensitive values of the payload in place
+func (r redactor) RedactPayload(payload map[interface{}]interface{}) {
+	if !r.enabled() {
+		return
+	}
+	for k, v := range payload {
+		if r.isSensitiveKey(k) {
+			payload[k] = r.replace(redactValueString(v))
+			continue
+		}
+		payload[k] = r.redactValue(v)
+	}
+}
+
+func (r redactor) redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return r.RedactMessage(t)
+	case []byte:
+		return r.RedactMessage(string(t))
+	case map[interface{}]interface{}:
+		r.RedactPayload(t)
+		return t
+	case []interface{}:
+		for idx, item := range t {
+			t[idx] = r.redactValue(item)
+		}
+		return t
+	}
+	if number, ok := numberString(v); ok {
+		if redacted := r.RedactMessage(number); redacted != number {
+			return redacted
+		}
+	}
+	return v
+}
+
+// numberString returns the decimal form of the numeric value
+func numberString(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case int:
+		return strconv.FormatInt(int64(t), 10), true
+	case int8:
+		return strconv.FormatInt(int64(t), 10), true
+	case int16:
+		return strconv.FormatInt(int64(t), 10), true
+	case int32:
+		return strconv.FormatInt(int64(t), 10), true
+	case int64:
+		return strconv.FormatInt(t, 10), true
+	case uint:
+		return strconv.FormatUint(uint64(t), 10), true
+	case uint8:
+		return strconv.FormatUint(uint64(t), 10), true
+	case uint16:
+		return strconv.FormatUint(uint64(t), 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(t), 10), true
+	case uint64:
+		return strconv.FormatUint(t, 10), true
+	case float32:
+		return strconv.FormatFloat(float64(t), 'f', -1, 32), true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+func (r redactor) isSensitiveKey(k interface{}) bool {
+	var key string
+	switch t := k.(type) {
+	case string:
+		key = t
+	case []byte:
+		key = string(t)
+	default:
+		return false
+	}
+	for _, pattern := range r.keys {
+		if pattern.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// replace returns the replacement of the sensitive value according to redact_mode
+func (r redactor) replace(value string) string {
+	if r.mode != RedactModeHash {
+		return r.mask
+	}
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write([]byte(value))
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))[:redactHashLength]
+}
+
+func redactValueString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	}
+	return fmt.Sprint(v)
+}
+
+// parseRedactKeys parses redact_keys option value like `password,token,^authorization$`.
+// Patterns are case-insensitive and match any part of the key name.
+func parseRedactKeys(getConfigKey configKeyGetter) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, item := range parseListConfigKey(getConfigKey, "redact_keys") {
+		pattern, err := regexp.Compile("(?i)" + item)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidValue, "redact_keys item `%s`: %v", item, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// parseRedactValues parses names of built-in patterns of redact_values option and
+// the custom pattern of redact_value_regex option
+func parseRedactValues(getConfigKey configKeyGetter) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, name := range parseListConfigKey(getConfigKey, "redact_values") {
+		pattern, ok := builtinRedactPatterns[strings.ToLower(name)]
+		if !ok {
+			var names []string
+			for builtinName := range builtinRedactPatterns {
+				names = append(names, builtinName)
+			}
+			sort.Strings(names)
+			return nil, errors.Wrapf(ErrInvalidValue, "redact_values item `%s` must be one of %s", name, strings.Join(names, ", "))
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	if raw := getConfigKey("redact_value_regex"); raw != "" {
+		pattern, err := regexp.Compile(raw)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidValue, "redact_value_regex: %v", err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"yandex_logging/plugin/dto"
+)
+
+var ErrPartialFailure = errors.New("Some entries were rejected by Yandex Cloud Logging")
+
+const (
+	// PartialFailurePolicyIgnore treats a chunk as delivered even if some of its entries were rejected
+	PartialFailurePolicyIgnore = "ignore"
+	// PartialFailurePolicyRetry fails the chunk so fluent-bit retries it
+	PartialFailurePolicyRetry = "retry"
+
+	// RejectedFallbackLog writes every rejected entry into the plugin log
+	RejectedFallbackLog = "log"
+	// RejectedFallbackDrop drops rejected entries, only the summary is logged
+	RejectedFallbackDrop = "drop"
+	// RejectedFallbackDeadLetter writes rejected entries into the dead letter file
+	RejectedFallbackDeadLetter = "dead_letter"
+)
+
+// rejectedEntry is an entry which was not accepted by Yandex Cloud Logging
+type rejectedEntry struct {
+	entry       *dto.YCLogRecordEntry
+	destination dto.YCLogRecordDestination
+	resource    dto.YCLogRecordResource
+	reason      string
+}
+
+// rejectedEntriesFallback receives entries rejected by Yandex Cloud Logging
+type rejectedEntriesFallback interface {
+	// handle processes rejected entries
+	handle(entries []rejectedEntry)
+}
+
+func newRejectedEntriesFallback(config OutputPluginConfig, deadLetter *deadLetterFile) rejectedEntriesFallback {
+	switch config.RejectedEntriesFallback {
+	case RejectedFallbackDrop:
+		return dropRejectedFallback{}
+	case RejectedFallbackDeadLetter:
+		return deadLetterRejectedFallback{deadLetter: deadLetter}
+	default:
+		return logRejectedFallback{pluginInstanceID: config.PluginInstanceId}
+	}
+}
+
+type dropRejectedFallback struct{}
+
+func (dropRejectedFallback) handle([]rejectedEntry) {}
+
+type logRejectedFallback struct {
+	pluginInstanceID int
+}
+
+func (f logRejectedFallback) handle(entries []rejectedEntry) {
+	for _, r := range entries {
+		log.Warnf("[yandexcloud %d] rejected entry: reason=`%s` timestamp=`%s` level=`%s` message=`%s` payload=`%v`",
+			f.pluginInstanceID, r.reason, r.entry.Timestamp, r.entry.Level, r.entry.Message, r.entry.JsonPayload)
+	}
+}
+
+type deadLetterRejectedFallback struct {
+	deadLetter *deadLetterFile
+}
+
+func (f deadLetterRejectedFallback) handle(entries []rejectedEntry) {
+	records := make([]deadLetterRecord, 0, len(entries))
+	for _, r := range entries {
+		records = append(records, newDeadLetterRecord("rejected: "+r.reason, r.destination, r.resource, r.entry))
+	}
+	f.deadLetter.Write(records)
+}
+
+// handleRejectedEntries reports rejected entries, passes them to the fallback and applies the partial failure policy
+func handleRejectedEntries(config OutputPluginConfig, fallback rejectedEntriesFallback, total int, rejected []rejectedEntry) error {
+	if len(rejected) == 0 {
+		return nil
+	}
+
+	reasons := make(map[string]int)
+	for _, r := range rejected {
+		reasons[r.reason]++
+	}
+	summary := make([]string, 0, len(reasons))
+	for reason, count := range reasons {
+		summary = append(summary, fmt.Sprintf("%d: %s", count, reason))
+	}
+	sort.Strings(summary)
+	log.Errorf("[yandexcloud %d] %d of %d entries rejected: %s",
+		config.PluginInstanceId, len(rejected), total, strings.Join(summary, "; "))
+
+	fallback.handle(rejected)
+
+	if config.PartialFailurePolicy == PartialFailurePolicyRetry {
+		return errors.Wrapf(ErrPartialFailure, "%d of %d entries", len(rejected), total)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/rand"
+	"time"
+)
+
+var ErrPermanent = errors.New("Permanent failure")
+
+// permanentError marks an error which is not going to disappear if the request is repeated
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func (e permanentError) Is(target error) bool {
+	return target == ErrPermanent
+}
+
+// retryPolicy repeats failed requests with exponential backoff and jitter
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	jitter      float64
+}
+
+func newRetryPolicy(config OutputPluginConfig) retryPolicy {
+	return retryPolicy{
+		maxAttempts: config.RetryMaxAttempts,
+		baseDelay:   config.RetryBaseDelay,
+		maxDelay:    config.RetryMaxDelay,
+		jitter:      config.RetryJitter,
+	}
+}
+
+// do calls fn until it succeeds, fails with non-retryable error or attempts are exhausted.
+// Permanent errors are marked so they can be checked with errors.Is(err, ErrPermanent).
+func (r retryPolicy) do(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if isPermanentError(err) {
+			return permanentError{err: err}
+		}
+		if !isRetryableError(err) || attempt >= r.maxAttempts {
+			return err
+		}
+
+		timer := time.NewTimer(r.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrapf(err, "retry interrupted")
+		case <-timer.C:
+		}
+	}
+}
+
+// delay returns pause before the next attempt after the given failed one
+func (r retryPolicy) delay(attempt int) time.Duration {
+	d := r.baseDelay
+	for i := 1; i < attempt && d < r.maxDelay; i++ {
+		d *= 2
+	}
+	if r.maxDelay > 0 && d > r.maxDelay {
+		d = r.maxDelay
+	}
+	if r.jitter > 0 {
+		d -= time.Duration(rand.Float64() * r.jitter * float64(d))
+	}
+	return d
+}
+
+func isRetryableError(err error) bool {
+	switch status.Code(errors.Cause(err)) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+func isPermanentError(err error) bool {
+	switch status.Code(errors.Cause(err)) {
+	case codes.InvalidArgument, codes.PermissionDenied:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func Test_RetryPolicy_Do(t *testing.T) {
+	cases := []struct {
+		name             string
+		err              error
+		expectedAttempts int
+		permanent        bool
+	}{
+		{"unavailable", status.Error(codes.Unavailable, "unavailable"), 4, false},
+		{"resource_exhausted", status.Error(codes.ResourceExhausted, "quota"), 4, false},
+		{"deadline_exceeded", status.Error(codes.DeadlineExceeded, "timeout"), 4, false},
+		{"invalid_argument", status.Error(codes.InvalidArgument, "bad entry"), 1, true},
+		{"permission_denied", status.Error(codes.PermissionDenied, "denied"), 1, true},
+		{"internal", status.Error(codes.Internal, "internal"), 1, false},
+		{"not_grpc", fmt.Errorf("some error"), 1, false},
+	}
+
+	policy := retryPolicy{maxAttempts: 4, baseDelay: time.Millisecond, maxDelay: time.Millisecond * 2}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			attempts := 0
+			err := policy.do(context.Background(), func() error {
+				attempts++
+				return c.err
+			})
+			assert.Error(t, err)
+			assert.Equal(t, c.expectedAttempts, attempts)
+			assert.Equal(t, c.permanent, errors.Is(err, ErrPermanent))
+		})
+	}
+}
+
+func Test_RetryPolicy_SucceedsAfterRetry(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 3}
+	attempts := 0
+	err := policy.do(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return status.Error(codes.Unavailable, "unavailable")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func Test_RetryPolicy_Delay(t *testing.T) {
+	policy := retryPolicy{baseDelay: time.Millisecond * 100, maxDelay: time.Second}
+	assert.Equal(t, time.Millisecond*100, policy.delay(1))
+	assert.Equal(t, time.Millisecond*200, policy.delay(2))
+	assert.Equal(t, time.Millisecond*800, policy.delay(4))
+	assert.Equal(t, time.Second, policy.delay(10))
+
+	policy.jitter = 0.5
+	for attempt := 1; attempt < 10; attempt++ {
+		d := policy.delay(attempt)
+		assert.LessOrEqual(t, int64(d), int64(time.Second))
+		assert.GreaterOrEqual(t, int64(d), int64(time.Millisecond*50))
+	}
+}
+
+func Test_RetryPolicy_ContextCancelled(t *testing.T) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	cancelFn()
+
+	policy := retryPolicy{maxAttempts: 5, baseDelay: time.Hour, maxDelay: time.Hour}
+	attempts := 0
+	err := policy.do(ctx, func() error {
+		attempts++
+		return status.Error(codes.Unavailable, "unavailable")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
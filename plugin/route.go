@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+	"yandex_logging/plugin/dto"
+)
+
+// tagRoute sends events with the tag matching the pattern to the log group
+type tagRoute struct {
+	pattern    *regexp.Regexp
+	logGroupId string
+}
+
+// destinationRouter resolves the destination of the event by record fields or by the tag
+type destinationRouter struct {
+	logGroupIdKey recordAccessor
+	folderIdKey   recordAccessor
+	tagRoutes     []tagRoute
+}
+
+func newDestinationRouter(config OutputPluginConfig) destinationRouter {
+	return destinationRouter{
+		logGroupIdKey: config.LogGroupIdKey,
+		folderIdKey:   config.FolderIdKey,
+		tagRoutes:     config.TagLogGroupMap,
+	}
+}
+
+// Route returns the destination of the event. Record fields are checked first, then tag routes in the
+// order they are configured. false is returned if the destination is not resolved.
+func (r destinationRouter) Route(e *Event) (dto.YCLogRecordDestination, bool) {
+	if logGroupId, ok := r.logGroupIdKey.GetString(e.Record); ok {
+		return dto.YCLogRecordDestination{LogGroupID: logGroupId}, true
+	}
+	if folderId, ok := r.folderIdKey.GetString(e.Record); ok {
+		return dto.YCLogRecordDestination{FolderId: folderId}, true
+	}
+	for _, route := range r.tagRoutes {
+		if route.pattern.MatchString(e.Tag) {
+			return dto.YCLogRecordDestination{LogGroupID: route.logGroupId}, true
+		}
+	}
+	return dto.YCLogRecordDestination{}, false
+}
+
+// parseTagLogGroupMap parses tag_log_group_map option value like `kube\.prod\..*:e23abc,kube\.dev\..*:e23def`.
+// Patterns must match the whole tag.
+func parseTagLogGroupMap(raw string) ([]tagRoute, error) {
+	var routes []tagRoute
+	for _, item := range splitTagLogGroupMap(raw) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		idx := strings.LastIndex(item, ":")
+		if idx <= 0 || idx == len(item)-1 {
+			return nil, errors.Wrapf(ErrInvalidValue, "tag_log_group_map item `%s` must look like `tag_regex:log_group_id`", item)
+		}
+		pattern, err := regexp.Compile("^(?:" + strings.TrimSpace(item[:idx]) + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidValue, "tag_log_group_map item `%s`: %v", item, err)
+		}
+		routes = append(routes, tagRoute{
+			pattern:    pattern,
+			logGroupId: strings.TrimSpace(item[idx+1:]),
+		})
+	}
+	return routes, nil
+}
+
+// splitTagLogGroupMap splits tag_log_group_map items by commas which are not a part of the regex:
+// commas inside `{}` repetitions and `[]` classes and escaped ones are kept. A literal comma outside of them
+// must be escaped as `\,`.
+func splitTagLogGroupMap(raw string) []string {
+	var items []string
+	braces, inClass, start := 0, false, 0
+	for idx := 0; idx < len(raw); idx++ {
+		switch c := raw[idx]; {
+		case c == '\\':
+			idx++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c == '{':
+			braces++
+		case c == '}' && braces > 0:
+			braces--
+		case c == ',' && braces == 0:
+			items = append(items, raw[start:idx])
+			start = idx + 1
+		}
+	}
+	return append(items, raw[start:])
+}
+
+// resolveResource returns the resource of the event taken from record fields, resource_id and resource_type
+// are used if the fields are not found
+func resolveResource(config OutputPluginConfig, e *Event) dto.YCLogRecordResource {
+	resource := dto.YCLogRecordResource{ID: config.ResourceId, Type: config.ResourceType}
+	if id, ok := config.ResourceIdKey.GetString(e.Record); ok {
+		resource.ID = id
+	}
+	if resourceType, ok := config.ResourceTypeKey.GetString(e.Record); ok {
+		resource.Type = resourceType
+	}
+	return resource
+}
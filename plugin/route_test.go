@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"yandex_logging/plugin/dto"
+)
+
+func Test_ParseTagLogGroupMap(t *testing.T) {
+	routes, err := parseTagLogGroupMap(`kube\.prod\..*:prod_group, kube\.dev\..*:dev_group,`)
+	require.NoError(t, err)
+	require.Len(t, routes, 2)
+	assert.Equal(t, "prod_group", routes[0].logGroupId)
+	assert.True(t, routes[0].pattern.MatchString("kube.prod.app"))
+	assert.False(t, routes[0].pattern.MatchString("other.kube.prod.app"), "pattern should match the whole tag")
+
+	routes, err = parseTagLogGroupMap(`app\.[a-z]{1,3}:short_group,app\.[,[]x:class_group,app\,y:escaped_group`)
+	require.NoError(t, err)
+	require.Len(t, routes, 3, "commas of the regex should not split items")
+	assert.Equal(t, "short_group", routes[0].logGroupId)
+	assert.True(t, routes[0].pattern.MatchString("app.abc"))
+	assert.False(t, routes[0].pattern.MatchString("app.abcd"))
+	assert.True(t, routes[1].pattern.MatchString("app.[x"))
+	assert.Equal(t, "escaped_group", routes[2].logGroupId)
+	assert.True(t, routes[2].pattern.MatchString("app,y"))
+
+	for _, raw := range []string{"kube.*", "kube.*:", "kube[:group"} {
+		_, err := parseTagLogGroupMap(raw)
+		assert.True(t, errors.Is(err, ErrInvalidValue), "should fail on `%s`", raw)
+	}
+}
+
+func Test_DestinationRouter_Route(t *testing.T) {
+	config := OutputPluginConfig{}
+	config.LogGroupIdKey, _ = parseRecordAccessor("$kubernetes['labels']['log_group']")
+	config.FolderIdKey, _ = parseRecordAccessor("folder")
+	config.TagLogGroupMap, _ = parseTagLogGroupMap(`kube\.prod\..*:prod_group`)
+	router := newDestinationRouter(config)
+
+	cases := []struct {
+		event       *Event
+		destination dto.YCLogRecordDestination
+		ok          bool
+	}{
+		{
+			event: &Event{Tag: "kube.prod.app", Record: map[interface{}]interface{}{
+				"kubernetes": map[interface{}]interface{}{"labels": map[interface{}]interface{}{"log_group": "label_group"}},
+				"folder":     "record_folder",
+			}},
+			destination: dto.YCLogRecordDestination{LogGroupID: "label_group"},
+			ok:          true,
+		},
+		{
+			event:       &Event{Tag: "kube.prod.app", Record: map[interface{}]interface{}{"folder": "record_folder"}},
+			destination: dto.YCLogRecordDestination{FolderId: "record_folder"},
+			ok:          true,
+		},
+		{
+			event:       &Event{Tag: "kube.prod.app", Record: map[interface{}]interface{}{"folder": ""}},
+			destination: dto.YCLogRecordDestination{LogGroupID: "prod_group"},
+			ok:          true,
+		},
+		{
+			event: &Event{Tag: "kube.dev.app", Record: map[interface{}]interface{}{}},
+			ok:    false,
+		},
+	}
+	for idx, c := range cases {
+		destination, ok := router.Route(c.event)
+		assert.Equal(t, c.ok, ok, "case %d", idx)
+		assert.Equal(t, c.destination, destination, "case %d", idx)
+	}
+}
+
+func Test_ResolveResource(t *testing.T) {
+	config := OutputPluginConfig{ResourceId: "static_id", ResourceType: "k8s.pod"}
+	config.ResourceIdKey, _ = parseRecordAccessor("$kubernetes['pod_name']")
+	config.ResourceTypeKey, _ = parseRecordAccessor("resource_type")
+
+	resource := resolveResource(config, &Event{Record: map[interface{}]interface{}{
+		"kubernetes": map[interface{}]interface{}{"pod_name": "app-5d9f"},
+	}})
+	assert.Equal(t, dto.YCLogRecordResource{ID: "app-5d9f", Type: "k8s.pod"}, resource)
+
+	resource = resolveResource(config, &Event{Record: map[interface{}]interface{}{"resource_type": "vm"}})
+	assert.Equal(t, dto.YCLogRecordResource{ID: "static_id", Type: "vm"}, resource)
+}
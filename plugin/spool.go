@@ -0,0 +1,374 @@
+package plugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrSpoolFull = errors.New("Spool size limit exceeded")
+
+var (
+	spoolDirsMu sync.Mutex
+	// spoolDirs holds ids of plugin instances by spool directories they use. Instances sharing the directory
+	// would write the same segments and replay each other's batches, so each directory is used by one instance.
+	spoolDirs = make(map[string]int)
+)
+
+const (
+	// SpoolFsyncAlways syncs the segment after every written batch
+	SpoolFsyncAlways = "always"
+	// SpoolFsyncSegment syncs the segment when it is full and a new one is started
+	SpoolFsyncSegment = "segment"
+	// SpoolFsyncNever leaves syncing to the OS
+	SpoolFsyncNever = "never"
+
+	defaultSpoolMaxBytes     = 256 * 1024 * 1024
+	defaultSpoolSegmentBytes = 8 * 1024 * 1024
+
+	spoolSegmentExt  = ".seg"
+	spoolOffsetFile  = "replay.offset"
+	spoolHeaderBytes = 8
+)
+
+// diskSpool is an append-only queue of records stored in segment files of the directory. Records are read
+// in the order they were written, the read position is stored in the directory, so replay continues after restart.
+// Every record is stored as 4 bytes of length, 4 bytes of CRC32 and the data.
+type diskSpool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	fsync        string
+
+	mu         sync.Mutex
+	segments   []uint64
+	sizes      map[uint64]int64
+	totalBytes int64
+	writer     *os.File
+	writerID   uint64
+	readID     uint64
+	readOffset int64
+	closed     bool
+	// notify wakes up the reader when a record is added
+	notify chan struct{}
+}
+
+// openDiskSpool opens the spool in spool_dir, the directory must not be used by other plugin instances
+func openDiskSpool(config OutputPluginConfig) (*diskSpool, error) {
+	dir, err := acquireSpoolDir(config.SpoolDir, config.PluginInstanceId)
+	if err != nil {
+		return nil, err
+	}
+	s, err := loadDiskSpool(config, dir)
+	if err != nil {
+		releaseSpoolDir(dir)
+		return nil, err
+	}
+	return s, nil
+}
+
+func loadDiskSpool(config OutputPluginConfig, dir string) (*diskSpool, error) {
+	s := &diskSpool{
+		dir:          dir,
+		maxBytes:     int64(config.SpoolMaxBytes),
+		segmentBytes: int64(config.SpoolSegmentBytes),
+		fsync:        config.SpoolFsync,
+		sizes:        make(map[uint64]int64),
+		notify:       make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "unable to create spool directory")
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read spool directory")
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), spoolSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, id)
+		s.sizes[id] = f.Size()
+		s.totalBytes += f.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	s.loadOffset()
+	// records are never appended to segments of the previous run, their tail might be torn by a crash
+	if err := s.startSegment(); err != nil {
+		return nil, err
+	}
+	// segments before the read position were replayed, but not removed before the restart
+	for s.segments[0] < s.readID || (s.segments[0] == s.readID && s.readOffset >= s.sizes[s.readID]) {
+		if err := os.Remove(s.segmentPath(s.segments[0])); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		s.totalBytes -= s.sizes[s.segments[0]]
+		delete(s.sizes, s.segments[0])
+		s.segments = s.segments[1:]
+	}
+	if s.readID != s.segments[0] {
+		s.readID, s.readOffset = s.segments[0], 0
+		if err := s.storeOffset(); err != nil {
+			return nil, errors.Wrapf(err, "unable to store spool offset")
+		}
+	}
+	return s, nil
+}
+
+// acquireSpoolDir returns the absolute path of the spool directory unless it is used by another instance
+func acquireSpoolDir(dir string, pluginID int) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to resolve spool directory")
+	}
+	spoolDirsMu.Lock()
+	defer spoolDirsMu.Unlock()
+
+	if owner, ok := spoolDirs[abs]; ok {
+		return "", errors.Wrapf(ErrInvalidValue, "spool_dir `%s` is already used by plugin instance %d, every instance needs its own spool_dir",
+			dir, owner)
+	}
+	spoolDirs[abs] = pluginID
+	return abs, nil
+}
+
+func releaseSpoolDir(dir string) {
+	spoolDirsMu.Lock()
+	defer spoolDirsMu.Unlock()
+	delete(spoolDirs, dir)
+}
+
+func (s *diskSpool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, spoolSegmentExt))
+}
+
+func (s *diskSpool) loadOffset() {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, spoolOffsetFile))
+	if err != nil {
+		return
+	}
+	var id uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &id, &offset); err != nil {
+		log.Warnf("spool offset file is corrupted, replay starts from the oldest segment: %v", err)
+		return
+	}
+	if _, ok := s.sizes[id]; ok {
+		s.readID, s.readOffset = id, offset
+	}
+}
+
+func (s *diskSpool) storeOffset() error {
+	path := filepath.Join(s.dir, spoolOffsetFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d", s.readID, s.readOffset)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// startSegment closes the current segment and starts a new one
+func (s *diskSpool) startSegment() error {
+	if s.writer != nil {
+		if s.fsync != SpoolFsyncNever {
+			if err := s.writer.Sync(); err != nil {
+				return err
+			}
+		}
+		if err := s.writer.Close(); err != nil {
+			return err
+		}
+	}
+
+	id := uint64(1)
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1] + 1
+	}
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create spool segment")
+	}
+	s.writer = f
+	s.writerID = id
+	s.segments = append(s.segments, id)
+	s.sizes[id] = 0
+	return nil
+}
+
+// Append adds the record to the end of the spool
+func (s *diskSpool) Append(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writer == nil {
+		return errors.New("spool is closed")
+	}
+	size := int64(spoolHeaderBytes + len(data))
+	// the replayed segment is kept until the next record is written, it is released before the size check
+	if s.readID == s.writerID && s.readOffset > 0 && s.readOffset >= s.sizes[s.writerID] {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+		if err := s.removeReadSegment(); err != nil {
+			return err
+		}
+	}
+	if s.totalBytes+size > s.maxBytes {
+		return errors.Wrapf(ErrSpoolFull, "%d of %d bytes used", s.totalBytes, s.maxBytes)
+	}
+	if s.sizes[s.writerID] > 0 && s.sizes[s.writerID]+size > s.segmentBytes {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, size)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[spoolHeaderBytes:], data)
+	if _, err := s.writer.Write(record); err != nil {
+		return errors.Wrapf(err, "unable to write spool segment")
+	}
+	if s.fsync == SpoolFsyncAlways {
+		if err := s.writer.Sync(); err != nil {
+			return errors.Wrapf(err, "unable to sync spool segment")
+		}
+	}
+	s.sizes[s.writerID] += size
+	s.totalBytes += size
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peek returns the oldest record which is not acknowledged yet and the position after it,
+// nil is returned if the spool is empty
+func (s *diskSpool) Peek() ([]byte, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.readID == s.writerID && s.readOffset >= s.sizes[s.writerID] {
+			return nil, 0, nil
+		}
+		if s.readOffset >= s.sizes[s.readID] {
+			if err := s.removeReadSegment(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		data, err := s.readRecord(s.readID, s.readOffset)
+		if err == nil {
+			return data, s.readOffset + int64(spoolHeaderBytes+len(data)), nil
+		}
+		// the tail of the segment written before a crash might be torn, the rest of it is skipped
+		log.Warnf("spool segment %s is corrupted at offset %d, skipping the rest of it: %v",
+			s.segmentPath(s.readID), s.readOffset, err)
+		if s.readID == s.writerID {
+			return nil, 0, err
+		}
+		if err := s.removeReadSegment(); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+func (s *diskSpool) readRecord(id uint64, offset int64) ([]byte, error) {
+	f, err := os.Open(s.segmentPath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, spoolHeaderBytes)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if offset+spoolHeaderBytes+length > s.sizes[id] {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset+spoolHeaderBytes); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return data, nil
+}
+
+// removeReadSegment removes the fully read segment and moves the read position to the next one
+func (s *diskSpool) removeReadSegment() error {
+	if err := os.Remove(s.segmentPath(s.readID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.totalBytes -= s.sizes[s.readID]
+	delete(s.sizes, s.readID)
+	s.segments = s.segments[1:]
+	s.readID, s.readOffset = s.segments[0], 0
+	return s.storeOffset()
+}
+
+// Ack moves the read position past the record returned by Peek
+func (s *diskSpool) Ack(next int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readOffset = next
+	return s.storeOffset()
+}
+
+// Empty returns true if all records are acknowledged
+func (s *diskSpool) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readID == s.writerID && s.readOffset >= s.sizes[s.writerID]
+}
+
+// Size returns the number of bytes used by the spool segments
+func (s *diskSpool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.totalBytes
+}
+
+// Notify returns the channel signaled when a record is added
+func (s *diskSpool) Notify() <-chan struct{} {
+	return s.notify
+}
+
+// Close closes the current segment and releases the directory for other instances
+func (s *diskSpool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		releaseSpoolDir(s.dir)
+	}
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
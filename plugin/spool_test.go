@@ -0,0 +1,139 @@
+package plugin
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+func newTestSpoolConfig(t *testing.T) OutputPluginConfig {
+	return OutputPluginConfig{
+		SpoolDir:          t.TempDir(),
+		SpoolMaxBytes:     1024,
+		SpoolSegmentBytes: 64,
+		SpoolFsync:        SpoolFsyncAlways,
+	}
+}
+
+// readSpool reads and acknowledges all records of the spool
+func readSpool(t *testing.T, spool *diskSpool) []string {
+	var records []string
+	for {
+		data, next, err := spool.Peek()
+		require.NoError(t, err)
+		if data == nil {
+			return records
+		}
+		records = append(records, string(data))
+		require.NoError(t, spool.Ack(next))
+	}
+}
+
+func Test_DiskSpool_Order(t *testing.T) {
+	spool, err := openDiskSpool(newTestSpoolConfig(t))
+	require.NoError(t, err)
+	defer spool.Close()
+	assert.True(t, spool.Empty())
+
+	var expected []string
+	for i := 0; i < 10; i++ {
+		record := fmt.Sprintf("record_%d", i)
+		require.NoError(t, spool.Append([]byte(record)))
+		expected = append(expected, record)
+	}
+	assert.False(t, spool.Empty())
+	assert.True(t, len(spool.segments) > 1, "records should be split into segments")
+
+	data, _, err := spool.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "record_0", string(data), "peek should not move the read position")
+
+	assert.Equal(t, expected, readSpool(t, spool))
+	assert.True(t, spool.Empty())
+	assert.Equal(t, 1, len(spool.segments), "replayed segments should be removed")
+}
+
+func Test_DiskSpool_SizeLimit(t *testing.T) {
+	config := newTestSpoolConfig(t)
+	config.SpoolMaxBytes = 40
+	spool, err := openDiskSpool(config)
+	require.NoError(t, err)
+	defer spool.Close()
+
+	require.NoError(t, spool.Append([]byte("0123456789")))
+	require.NoError(t, spool.Append([]byte("0123456789")))
+	err = spool.Append([]byte("0123456789"))
+	assert.True(t, errors.Is(err, ErrSpoolFull))
+
+	readSpool(t, spool)
+	require.NoError(t, spool.Append([]byte("0123456789")), "space should be released by replay")
+}
+
+func Test_DiskSpool_Restart(t *testing.T) {
+	config := newTestSpoolConfig(t)
+	spool, err := openDiskSpool(config)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		require.NoError(t, spool.Append([]byte(fmt.Sprintf("record_%d", i))))
+	}
+	for i := 0; i < 2; i++ {
+		_, next, err := spool.Peek()
+		require.NoError(t, err)
+		require.NoError(t, spool.Ack(next))
+	}
+	require.NoError(t, spool.Close())
+
+	spool, err = openDiskSpool(config)
+	require.NoError(t, err)
+	require.NoError(t, spool.Append([]byte("record_6")))
+	assert.Equal(t, []string{"record_2", "record_3", "record_4", "record_5", "record_6"}, readSpool(t, spool))
+	require.NoError(t, spool.Close())
+
+	spool, err = openDiskSpool(config)
+	require.NoError(t, err)
+	defer spool.Close()
+	assert.True(t, spool.Empty())
+	assert.Equal(t, int64(0), spool.Size())
+}
+
+func Test_DiskSpool_SharedDir(t *testing.T) {
+	config := newTestSpoolConfig(t)
+	spool, err := openDiskSpool(config)
+	require.NoError(t, err)
+
+	other := config
+	other.PluginInstanceId = 1
+	other.SpoolDir = config.SpoolDir + string(os.PathSeparator) + "."
+	_, err = openDiskSpool(other)
+	assert.True(t, errors.Is(err, ErrInvalidValue), "spool_dir of another instance should be rejected")
+
+	require.NoError(t, spool.Close())
+	spool, err = openDiskSpool(other)
+	require.NoError(t, err, "spool_dir should be released on close")
+	require.NoError(t, spool.Close())
+}
+
+func Test_DiskSpool_TornSegment(t *testing.T) {
+	config := newTestSpoolConfig(t)
+	config.SpoolSegmentBytes = 1024
+	spool, err := openDiskSpool(config)
+	require.NoError(t, err)
+	require.NoError(t, spool.Append([]byte("record_0")))
+	require.NoError(t, spool.Append([]byte("record_1")))
+	path := spool.segmentPath(spool.writerID)
+	require.NoError(t, spool.Close())
+
+	// the last record is partially written before the crash
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-3))
+
+	spool, err = openDiskSpool(config)
+	require.NoError(t, err)
+	defer spool.Close()
+	require.NoError(t, spool.Append([]byte("record_2")))
+	assert.Equal(t, []string{"record_0", "record_2"}, readSpool(t, spool))
+}
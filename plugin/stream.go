@@ -0,0 +1,36 @@
+package plugin
+
+import (
+	"regexp"
+)
+
+const (
+	// maxStreamNameLength is the max length of the stream name accepted by Yandex Cloud Logging
+	maxStreamNameLength = 63
+
+	// StreamNameKeyTag is stream_name_key value to take the stream name from the fluent-bit tag
+	StreamNameKeyTag = "$TAG"
+)
+
+var invalidStreamNameChars = regexp.MustCompile(`[^-a-zA-Z0-9_.]`)
+
+// sanitizeStreamName replaces characters not allowed in the stream name and cuts it to the allowed length
+func sanitizeStreamName(name string) string {
+	name = invalidStreamNameChars.ReplaceAllString(name, "_")
+	if len(name) > maxStreamNameLength {
+		name = name[:maxStreamNameLength]
+	}
+	return name
+}
+
+// resolveStreamName returns the stream name of the event taken from the tag or the record field,
+// stream_name is used if the field is not found
+func resolveStreamName(config OutputPluginConfig, e *Event) string {
+	name := config.StreamName
+	if config.StreamNameFromTag {
+		name = e.Tag
+	} else if value, ok := config.StreamNameKey.GetString(e.Record); ok {
+		name = value
+	}
+	return sanitizeStreamName(name)
+}
@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yandex-cloud/go-genproto/yandex/cloud/logging/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"strings"
+	"testing"
+)
+
+func Test_SanitizeStreamName(t *testing.T) {
+	assert.Equal(t, "kube.var.log.containers.app_ns_nginx-1", sanitizeStreamName("kube.var.log.containers.app_ns_nginx-1"))
+	assert.Equal(t, "app_stdout_", sanitizeStreamName("app/stdout:"))
+	assert.Equal(t, maxStreamNameLength, len(sanitizeStreamName(strings.Repeat("a", 100))))
+}
+
+func Test_ResolveStreamName(t *testing.T) {
+	event := &Event{
+		Tag:    "kube.app",
+		Record: map[interface{}]interface{}{"stream": "stdout"},
+	}
+
+	config := OutputPluginConfig{StreamName: "default"}
+	assert.Equal(t, "default", resolveStreamName(config, event))
+
+	config.StreamNameKey, _ = parseRecordAccessor("stream")
+	assert.Equal(t, "stdout", resolveStreamName(config, event))
+
+	config.StreamNameKey, _ = parseRecordAccessor("missing")
+	assert.Equal(t, "default", resolveStreamName(config, event))
+
+	config.StreamNameFromTag = true
+	assert.Equal(t, "kube.app", resolveStreamName(config, event))
+}
+
+func Test_WriteRequestJSON_StreamName(t *testing.T) {
+	wr := &logging.WriteRequest{Entries: []*logging.IncomingLogEntry{
+		{Message: "first", StreamName: "stdout"},
+		{Message: "second"},
+	}}
+
+	b, err := protojson.Marshal(wr)
+	require.NoError(t, err)
+
+	var body struct {
+		Entries []map[string]interface{} `json:"entries"`
+	}
+	require.NoError(t, json.Unmarshal(b, &body))
+	require.Len(t, body.Entries, 2)
+	assert.Equal(t, map[string]interface{}{"message": "first", "streamName": "stdout"}, body.Entries[0])
+	assert.Equal(t, map[string]interface{}{"message": "second"}, body.Entries[1])
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	fluentbit "github.com/fluent/fluent-bit-go/output"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"time"
 	"unsafe"
@@ -36,15 +37,27 @@ func FLBPluginInit(ctx unsafe.Pointer) int {
 func addPluginInstance(ctx unsafe.Pointer) error {
 	pluginID := len(pluginInstances)
 
-	config := plugin.NewOutputPluginConfig(ctx, pluginID)
-	err := config.Validate()
+	config, err := plugin.NewOutputPluginConfig(ctx, pluginID)
+	if err != nil {
+		return err
+	}
+	err = config.Validate()
 	if err != nil {
 		return err
 	}
 
-	logSender, err := plugin.NewGRPCLogSender(context.Background(), config)
+	var logSender plugin.LogSender
+	switch config.Transport {
+	case plugin.TransportHTTP:
+		logSender, err = plugin.NewYandexCloudHTTPClient(context.Background(), config)
+	default:
+		logSender, err = plugin.NewGRPCLogSender(context.Background(), config)
+	}
 	if err != nil {
-		return fmt.Errorf("log sender configuration error")
+		return fmt.Errorf("log sender configuration error: %v", err)
+	}
+	if config.Async {
+		logSender = plugin.NewAsyncLogSender(config, logSender)
 	}
 	pluginInstance := plugin.NewYandexCloudOutputPlugin(config, logSender)
 
@@ -66,6 +79,7 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 
 	fluentTag := C.GoString(tag)
 	log.Debugf("[yandexcloud %d] Found logs with tag: %s", ycLogPlugin.GetPluginInstanceID(), fluentTag)
+	ycLogPlugin.BeginChunk(fluentTag, C.GoBytes(data, length))
 
 	count := 0
 	for {
@@ -73,7 +87,6 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 		if ret != 0 {
 			break
 		}
-		log.Printf("record: %v", record)
 
 		var timestamp time.Time
 		switch t := ts.(type) {
@@ -96,6 +109,9 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 	err := ycLogPlugin.Flush()
 	if err != nil {
 		log.Errorln(err)
+		if errors.Is(err, plugin.ErrPermanent) {
+			return fluentbit.FLB_ERROR
+		}
 		return fluentbit.FLB_RETRY
 	}
 
@@ -104,9 +120,26 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 
 }
 
+//export FLBPluginExitCtx
+func FLBPluginExitCtx(ctx unsafe.Pointer) int {
+	ycLogPlugin := getPluginInstance(ctx)
+	if err := ycLogPlugin.Close(); err != nil {
+		log.Errorf("[yandexcloud %d] %v", ycLogPlugin.GetPluginInstanceID(), err)
+		return fluentbit.FLB_ERROR
+	}
+	return fluentbit.FLB_OK
+}
+
 //export FLBPluginExit
 func FLBPluginExit() int {
-	return fluentbit.FLB_OK
+	retCode := fluentbit.FLB_OK
+	for _, ycLogPlugin := range pluginInstances {
+		if err := ycLogPlugin.Close(); err != nil {
+			log.Errorf("[yandexcloud %d] %v", ycLogPlugin.GetPluginInstanceID(), err)
+			retCode = fluentbit.FLB_ERROR
+		}
+	}
+	return retCode
 }
 
 func main() {